@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"github.com/Matir/httpwatch/output"
 	"github.com/Matir/httpwatch/rules"
 	"io/ioutil"
 	"log"
@@ -18,23 +20,37 @@ type RepeatedStringFlag []string
 // Flag definitons
 var configFilename = flag.String("config", "~/.httpwatch", "Configuration file location.")
 var logfileName = flag.String("logfile", "", "Logfile for output.")
+var checkConfig = flag.Bool("check-config", false, "Check the configuration and rules, then exit.")
 var interfaces RepeatedStringFlag
 var pcapfiles RepeatedStringFlag
 
 // Config represents the whole config
 type Config struct {
-	Filename   string
-	Logfile    string
-	Rules      []rules.Rule
-	Interfaces []string
-	PcapFiles  []string
-	Outputs    []outputConfig
-	Logger     *log.Logger
+	Filename         string
+	Logfile          string
+	Rules            []rules.Rule
+	Interfaces       []string
+	PcapFiles        []string
+	Outputs          []outputConfig
+	ProtoDescriptors []string
+	Lists            map[string]string
+	RuleFiles        []string
+	Detectors        []string
+	JWKS             string
+	Engine           string
+	Workers          int
+	CheckOnly        bool
+	Logger           *log.Logger
 }
 
+// outputConfig is an output and the matches routed to it: those from rules
+// named in Rules or tagged with one of Tags, or every match if both are
+// empty.
 type outputConfig struct {
 	Name    string
 	Options map[string]string
+	Rules   []string
+	Tags    []string
 }
 
 func (c *Config) ParseConfigFile(name string) {
@@ -66,6 +82,7 @@ func (c *Config) Init() {
 	if len(pcapfiles) > 0 {
 		c.PcapFiles = pcapfiles
 	}
+	c.CheckOnly = *checkConfig
 
 	// Setup logfile from config
 	if *logfileName != "" {
@@ -81,12 +98,80 @@ func (c *Config) Init() {
 	}
 }
 
+// LoadRuleFiles adds the rules from each of RuleFiles to Rules, converting
+// them according to the file extension: .rules for Suricata rules, or .yml
+// and .yaml for Sigma rules.  Rules that cannot be converted are logged and
+// skipped.
+func (c *Config) LoadRuleFiles() error {
+	for _, name := range c.RuleFiles {
+		var loaded []rules.Rule
+		var err error
+		switch filepath.Ext(name) {
+		case ".rules":
+			loaded, err = rules.LoadSuricataFile(name)
+		case ".yml", ".yaml":
+			loaded, err = rules.LoadSigmaFile(name)
+		default:
+			return fmt.Errorf("Unknown type of rule file: %s", name)
+		}
+		switch skipped := err.(type) {
+		case nil:
+		case rules.SuricataErrors:
+			for _, e := range skipped {
+				c.Logger.Printf("Skipping rule %v\n", e)
+			}
+		case rules.SigmaErrors:
+			for _, e := range skipped {
+				c.Logger.Printf("Skipping rule %v\n", e)
+			}
+		default:
+			return fmt.Errorf("Unable to load rules from %s: %v", name, err)
+		}
+		c.Rules = append(c.Rules, loaded...)
+	}
+	return nil
+}
+
+// AddDetectors adds a rule to Rules for each built-in detector enabled by
+// Detectors, a list of patterns such as secret.* (see rules.DetectorRules).
+func (c *Config) AddDetectors() error {
+	if len(c.Detectors) == 0 {
+		return nil
+	}
+	detectorRules, err := rules.DetectorRules(c.Detectors)
+	if err != nil {
+		return err
+	}
+	c.Rules = append(c.Rules, detectorRules...)
+	return nil
+}
+
+// Valid checks the config, compiling every rule.  Named lists and proto
+// descriptors the rules use must already be loaded.  When only checking the
+// config, no source or output is needed.
 func (c *Config) Valid() error {
-	if len(c.PcapFiles)+len(c.Interfaces) == 0 {
-		return errors.New("Need a pcap or interface!")
+	var errs []string
+	if !c.CheckOnly {
+		if len(c.PcapFiles)+len(c.Interfaces) == 0 {
+			errs = append(errs, "Need a pcap or interface!")
+		}
+		if len(c.Outputs) == 0 {
+			errs = append(errs, "Need an output!")
+		}
+	}
+	if c.Engine != "" && c.Engine != "rules" && c.Engine != "pool" {
+		errs = append(errs, fmt.Sprintf("Invalid engine %s, must be rules or pool", c.Engine))
+	}
+	for _, o := range c.Outputs {
+		if err := (output.Filter{Rules: o.Rules, Tags: o.Tags}).Valid(); err != nil {
+			errs = append(errs, fmt.Sprintf("Output %s: %v", o.Name, err))
+		}
+	}
+	if err := rules.CompileRules(c.Rules); err != nil {
+		errs = append(errs, err.Error())
 	}
-	if len(c.Outputs) == 0 {
-		return errors.New("Need an output!")
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
 	}
 	return nil
 }
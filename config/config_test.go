@@ -0,0 +1,24 @@
+package config
+
+import (
+	"github.com/Matir/httpwatch/rules"
+	"strings"
+	"testing"
+)
+
+func TestValidCheckOnly(t *testing.T) {
+	c := &Config{Rules: []rules.Rule{{Name: "get", Expr: `request.method == "GET"`}}}
+	err := c.Valid()
+	if err == nil || !strings.Contains(err.Error(), "Need a pcap or interface!") || !strings.Contains(err.Error(), "Need an output!") {
+		t.Errorf("Expected errors for the missing source and output, got %v\n", err)
+	}
+
+	c.CheckOnly = true
+	if err := c.Valid(); err != nil {
+		t.Errorf("Unexpected error checking only: %v\n", err)
+	}
+	c.Rules = append(c.Rules, rules.Rule{Name: "bad", Expr: "request.method =="})
+	if err := c.Valid(); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("Expected an error for an invalid rule, got %v\n", err)
+	}
+}
@@ -1,5 +1,20 @@
 module github.com/Matir/httpwatch
 
-go 1.15
+go 1.17
 
-require github.com/google/gopacket v1.1.19
+require (
+	github.com/andybalholm/cascadia v1.3.3
+	github.com/antchfx/xmlquery v1.4.4
+	github.com/antchfx/xpath v1.3.3
+	github.com/google/gopacket v1.1.19
+	go.starlark.net v0.0.0-20230525235612-a134d8f9ddca
+	golang.org/x/net v0.33.0
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
@@ -9,35 +9,60 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // RequestResponsePair is a container for an associated
 // http.Request and http.Response, along with a copy of their bodies,
 // to allow repeated inspection.
+//
+// RequestTime and ResponseTime are the capture times of the first byte of
+// the request and response, and ClientAddr and ServerAddr the endpoints of
+// the connection, when read from captured streams.
+//
+// For text/event-stream responses, which may stay open indefinitely, Events
+// holds the first maxStreamEvents decoded events and ResponseBody the first
+// maxStreamBody bytes.  Every event is also delivered while the stream is
+// open as a sub-record: a pair sharing the Request and Response, with no
+// ResponseBody and Event set.
 type RequestResponsePair struct {
 	Request      *http.Request
 	RequestBody  []byte
 	Response     *http.Response
 	ResponseBody []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+	ClientAddr   *net.TCPAddr
+	ServerAddr   *net.TCPAddr
+	Events       []*ServerSentEvent
+	Event        *ServerSentEvent
 	fingerprint  *string
+	cache        map[string]*memoEntry
+	cacheLock    sync.Mutex
 }
 
 // HTTPConnection represents the HTTP transactions within a single
 // TCP session.  It may contain 1 or more RequestResponsePairs.
 // Multiple pairs will be included in a keep-alive connection.
 type HTTPConnection struct {
-	Pairs    []*RequestResponsePair
-	key      connKey
-	data     [2][]byte
-	cdata    int
-	fin      chan bool
-	Finished func(*HTTPConnection)
-	err      error
+	Pairs        []*RequestResponsePair
+	key          connKey
+	streams      [2]*connStream
+	cdata        int
+	reqStream    *streamReader
+	respStream   *streamReader
+	clientAddr   *net.TCPAddr
+	serverAddr   *net.TCPAddr
+	Finished     func(*HTTPConnection)
+	EventDecoded func(*RequestResponsePair)
+	err          error
 }
 
 // bodyBuffer implements ReaderCloser by wrapping a bytes.Reader.
@@ -47,25 +72,14 @@ type bodyBuffer struct {
 
 // NewHTTPConnection reates an HTTPConnection for a given key with a callback.
 func NewHTTPConnection(key connKey, finished func(*HTTPConnection)) *HTTPConnection {
-	c := &HTTPConnection{Finished: finished, key: key}
-	c.fin = make(chan bool, 2)
-	return c
+	return &HTTPConnection{Finished: finished, key: key}
 }
 
-// AddStream adds a ReaderStream to the connection conn.
-func (conn *HTTPConnection) AddStream(s *tcpreader.ReaderStream) {
-	// launch a goroutine to read everything
-	choice := conn.cdata
+// AddStream adds one direction of the TCP session to the connection conn.
+// Parsing starts as soon as both directions have been added.
+func (conn *HTTPConnection) AddStream(s *connStream) {
+	conn.streams[conn.cdata] = s
 	conn.cdata++
-	go func() {
-		data, err := ioutil.ReadAll(s)
-		conn.data[choice] = data
-		if err != nil {
-			logger.Printf("Unable to read all from connection: %v\n", err)
-			conn.err = err
-		}
-		conn.fin <- true
-	}()
 	if conn.cdata == 2 {
 		go conn.startReadConnection()
 	}
@@ -73,9 +87,6 @@ func (conn *HTTPConnection) AddStream(s *tcpreader.ReaderStream) {
 
 // Read the connection data into Request/Response Pairs
 func (conn *HTTPConnection) startReadConnection() {
-	// Wait for 2 to be finished
-	<-conn.fin
-	<-conn.fin
 	request, response, err := conn.sortStreams()
 	if err != nil {
 		logger.Printf("Error getting request/response: %v\n", err)
@@ -103,10 +114,13 @@ func (conn *HTTPConnection) readConnection(request, response *bufio.Reader) {
 	}
 
 	for {
+		reqStart := streamOffset(conn.reqStream, request)
+		streamRelease(conn.reqStream, reqStart)
 		req, err := http.ReadRequest(request)
 		if handleErr(err) {
 			return
 		}
+		reqTime := streamSeenAt(conn.reqStream, reqStart)
 		// Replace the body
 		reqbuf, err := ioutil.ReadAll(req.Body)
 		req.Body.Close()
@@ -118,6 +132,8 @@ func (conn *HTTPConnection) readConnection(request, response *bufio.Reader) {
 		handleErr(err)
 
 		// Try to read a matching response
+		respStart := streamOffset(conn.respStream, response)
+		streamRelease(conn.respStream, respStart)
 		resp, err := http.ReadResponse(response, req)
 		if handleErr(err) {
 			return
@@ -125,15 +141,20 @@ func (conn *HTTPConnection) readConnection(request, response *bufio.Reader) {
 
 		// Replace the body
 		// TODO: figure out a lower memory version of this
-		respbuf, err := ioutil.ReadAll(resp.Body)
+		pair := &RequestResponsePair{Request: req,
+			RequestBody: reqbuf, Response: resp, RequestTime: reqTime,
+			ResponseTime: streamSeenAt(conn.respStream, respStart),
+			ClientAddr:   conn.clientAddr, ServerAddr: conn.serverAddr}
+		if isEventStream(resp) {
+			err = conn.readEventStream(pair, response)
+		} else {
+			pair.ResponseBody, err = ioutil.ReadAll(resp.Body)
+		}
 		if handleErr(err) {
 			return
 		}
 		resp.Body.Close()
-		resp.Body = &bodyBuffer{bytes.NewReader(respbuf)}
-
-		pair := &RequestResponsePair{Request: req,
-			RequestBody: reqbuf, Response: resp, ResponseBody: respbuf}
+		resp.Body = &bodyBuffer{bytes.NewReader(pair.ResponseBody)}
 		conn.Pairs = append(conn.Pairs, pair)
 
 		err = consumeWhitespace(response)
@@ -145,6 +166,138 @@ func (conn *HTTPConnection) readConnection(request, response *bufio.Reader) {
 	}
 }
 
+// Limits on what an event stream keeps in its pair
+const (
+	maxStreamBody   = 1 << 20
+	maxStreamEvents = 1000
+)
+
+// Decode the events of a text/event-stream response body as they arrive,
+// passing each one to the EventDecoded callback.  The stream data of each
+// event is released once it is decoded.
+func (conn *HTTPConnection) readEventStream(pair *RequestResponsePair, response *bufio.Reader) error {
+	body := &limitedBuffer{limit: maxStreamBody}
+	tracker := &bodyTracker{r: pair.Response.Body, pos: func() int {
+		return streamOffset(conn.respStream, response)
+	}}
+	dec := newEventDecoder(io.TeeReader(tracker, body))
+	defer func() {
+		pair.ResponseBody = body.Bytes()
+	}()
+	for {
+		ev, err := dec.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// The event ends with the last byte the decoder has used
+		end := tracker.streamOffset(tracker.n - dec.r.Buffered() - 1)
+		ev.Timestamp = conn.responseSeenAt(end)
+		streamRelease(conn.respStream, end)
+		if len(pair.Events) < maxStreamEvents {
+			pair.Events = append(pair.Events, ev)
+		}
+		if conn.EventDecoded != nil {
+			conn.EventDecoded(&RequestResponsePair{Request: pair.Request,
+				RequestBody: pair.RequestBody, Response: pair.Response, Event: ev,
+				ClientAddr: pair.ClientAddr, ServerAddr: pair.ServerAddr})
+		}
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it, discarding the
+// rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// Capture time of the response data at offset, or the current time if the
+// connection is not backed by captured streams.
+func (conn *HTTPConnection) responseSeenAt(offset int) time.Time {
+	if conn.respStream == nil {
+		return time.Now()
+	}
+	return streamSeenAt(conn.respStream, offset)
+}
+
+// bodyTracker maps offsets in a body back to offsets in the stream it is
+// read from, by recording the stream position after each read.  Offsets
+// within a read that spans the framing of a chunked body are approximate.
+type bodyTracker struct {
+	r     io.Reader
+	pos   func() int
+	n     int
+	marks []bodyMark
+}
+
+// bodyMark is the stream position once the body up to offset body is read.
+type bodyMark struct {
+	body   int
+	stream int
+}
+
+func (t *bodyTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.n += n
+		t.marks = append(t.marks, bodyMark{t.n, t.pos()})
+	}
+	return n, err
+}
+
+// streamOffset returns the stream offset of the body byte at offset, or -1
+// if unknown.  Offsets must not decrease, as earlier marks are dropped.
+func (t *bodyTracker) streamOffset(offset int) int {
+	i := sort.Search(len(t.marks), func(i int) bool {
+		return t.marks[i].body > offset
+	})
+	if offset < 0 || i == len(t.marks) {
+		return -1
+	}
+	t.marks = t.marks[i:]
+	m := t.marks[0]
+	if m.stream < 0 {
+		return -1
+	}
+	return m.stream - (m.body - offset)
+}
+
+// Position of the next unread byte of a buffered stream, or -1 if the
+// connection is not backed by captured streams.
+func streamOffset(sr *streamReader, br *bufio.Reader) int {
+	if sr == nil {
+		return -1
+	}
+	return sr.offset - br.Buffered()
+}
+
+// Release the data of a captured stream before offset.
+func streamRelease(sr *streamReader, offset int) {
+	if sr != nil && offset >= 0 {
+		sr.Release(offset)
+	}
+}
+
+// Capture time of the data at offset, or the zero time if unknown.
+func streamSeenAt(sr *streamReader, offset int) time.Time {
+	if sr == nil || offset < 0 {
+		return time.Time{}
+	}
+	return sr.s.SeenAt(offset)
+}
+
 // Success returns true if any connection data was read, false otherwise.
 func (conn *HTTPConnection) Success() bool {
 	return len(conn.Pairs) > 0
@@ -152,16 +305,19 @@ func (conn *HTTPConnection) Success() bool {
 
 // Who is the request & response?
 func (conn *HTTPConnection) sortStreams() (*bufio.Reader, *bufio.Reader, error) {
-	a := bufio.NewReader(bytes.NewReader(conn.data[0]))
-	b := bufio.NewReader(bytes.NewReader(conn.data[1]))
+	sa, sb := conn.streams[0].NewReader(), conn.streams[1].NewReader()
+	a, b := bufio.NewReader(sa), bufio.NewReader(sb)
 	peek, err := a.Peek(5)
 	if err != nil {
 		return nil, nil, err
 	}
 	if string(peek) == "HTTP/" {
 		// a is a response
-		return b, a, nil
+		sa, sb = sb, sa
+		a, b = b, a
 	}
+	conn.reqStream, conn.respStream = sa, sb
+	conn.clientAddr, conn.serverAddr = sa.s.srcAddr(), sb.s.srcAddr()
 	return a, b, nil
 }
 
@@ -207,9 +363,39 @@ func (p *RequestResponsePair) Fingerprint() string {
 		}
 		h.Write(p.ResponseBody)
 	}
+	if p.Event != nil {
+		h.Write([]byte(p.Event.ID + "\n" + p.Event.Event + "\n" + p.Event.Data))
+		h.Write([]byte(p.Event.Timestamp.String()))
+	}
 	s := hex.EncodeToString(h.Sum(nil))
 	p.fingerprint = &s
 	return *p.fingerprint
 }
 
+// memoEntry is a value computed once by Memoize.
+type memoEntry struct {
+	once  sync.Once
+	value interface{}
+}
+
+// Memoize returns the value stored under key, calling build to compute it
+// the first time.  This lets parsed views of the pair, such as decoded
+// bodies, be shared between every rule that inspects it.  build runs exactly
+// once per key, and only blocks other callers for the same key, so it may
+// itself use Memoize for other keys.
+func (p *RequestResponsePair) Memoize(key string, build func() interface{}) interface{} {
+	p.cacheLock.Lock()
+	if p.cache == nil {
+		p.cache = make(map[string]*memoEntry)
+	}
+	e, ok := p.cache[key]
+	if !ok {
+		e = &memoEntry{}
+		p.cache[key] = e
+	}
+	p.cacheLock.Unlock()
+	e.once.Do(func() { e.value = build() })
+	return e.value
+}
+
 func (b *bodyBuffer) Close() error { return nil }
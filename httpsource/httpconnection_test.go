@@ -2,10 +2,16 @@ package httpsource
 
 import (
 	"bufio"
+	"bytes"
+	"github.com/google/gopacket/tcpassembly"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func fatalIfErr(t *testing.T, err error) {
@@ -46,3 +52,73 @@ func TestReadConnection(t *testing.T) {
 		t.Fatalf("Got an error: %v\n", conn.err)
 	}
 }
+
+func TestReadConnectionTimestamps(t *testing.T) {
+	reqs, err := ioutil.ReadFile(filepath.Join("testdata", "requests.txt"))
+	fatalIfErr(t, err)
+	resps, err := ioutil.ReadFile(filepath.Join("testdata", "responses.txt"))
+	fatalIfErr(t, err)
+	t0 := time.Unix(1000, 0)
+	req, resp := newConnStream(), newConnStream()
+	// Deliver each message as its own segment
+	split := bytes.Index(reqs, []byte("GET /favicon"))
+	req.Reassembled([]tcpassembly.Reassembly{{Bytes: reqs[:split], Seen: t0}})
+	req.Reassembled([]tcpassembly.Reassembly{{Bytes: reqs[split:], Seen: t0.Add(2 * time.Second)}})
+	split = bytes.Index(resps, []byte("HTTP/1.1 204"))
+	resp.Reassembled([]tcpassembly.Reassembly{{Bytes: resps[:split], Seen: t0.Add(time.Second)}})
+	resp.Reassembled([]tcpassembly.Reassembly{{Bytes: resps[split:], Seen: t0.Add(3 * time.Second)}})
+	req.ReassemblyComplete()
+	resp.ReassemblyComplete()
+
+	conn := NewHTTPConnection(connKey{}, func(*HTTPConnection) {})
+	// Add the response first to check the streams are sorted
+	conn.streams = [2]*connStream{resp, req}
+	conn.startReadConnection()
+	if len(conn.Pairs) != 2 {
+		t.Fatalf("Expected 2 pairs, got %d.\n", len(conn.Pairs))
+	}
+	for i, pair := range conn.Pairs {
+		reqTime := t0.Add(time.Duration(2*i) * time.Second)
+		if !pair.RequestTime.Equal(reqTime) || !pair.ResponseTime.Equal(reqTime.Add(time.Second)) {
+			t.Errorf("Pair %d: unexpected times %v, %v\n", i, pair.RequestTime, pair.ResponseTime)
+		}
+	}
+}
+
+func TestMemoize(t *testing.T) {
+	pair := &RequestResponsePair{}
+	calls := 0
+	build := func() interface{} {
+		calls++
+		// Nested use must not deadlock
+		return pair.Memoize("inner", func() interface{} { return "inner" }).(string) + "!"
+	}
+	if v := pair.Memoize("outer", build); v != "inner!" {
+		t.Errorf("Unexpected value %v\n", v)
+	}
+	if v := pair.Memoize("outer", build); v != "inner!" || calls != 1 {
+		t.Errorf("Expected a cached value, got %v after %d calls\n", v, calls)
+	}
+
+	// Concurrent callers wait for the one build
+	var builds int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v := pair.Memoize("slow", func() interface{} {
+				atomic.AddInt32(&builds, 1)
+				time.Sleep(10 * time.Millisecond)
+				return 42
+			})
+			if v != 42 {
+				t.Errorf("Unexpected value %v\n", v)
+			}
+		}()
+	}
+	wg.Wait()
+	if builds != 1 {
+		t.Errorf("Expected 1 build, got %d\n", builds)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 	"log"
 	"os"
 	"sync"
@@ -45,7 +44,8 @@ func NewHTTPSource() *HTTPSource {
 
 // New creates a new stream for a given flow
 func (src *HTTPSource) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
-	stream := tcpreader.NewReaderStream()
+	stream := newConnStream()
+	stream.netFlow, stream.tcpFlow = netFlow, tcpFlow
 	// Add to mappings
 	key := connKey{netFlow, tcpFlow}
 	logger.Printf("Using key: %v\n", key)
@@ -57,10 +57,20 @@ func (src *HTTPSource) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
 	}
 	if !ok {
 		conn = NewHTTPConnection(key, src.connectionFinished)
+		conn.EventDecoded = src.eventDecoded
 		src.pending[key] = conn
 	}
-	conn.AddStream(&stream)
-	return &stream
+	conn.AddStream(stream)
+	return stream
+}
+
+// Callback for each event decoded from an event stream that is still open.
+// Events are only delivered as sub-records in pairs mode; otherwise they are
+// available on the pair once the connection has finished.
+func (src *HTTPSource) eventDecoded(pair *RequestResponsePair) {
+	if src.Pairs != nil {
+		src.Pairs <- pair
+	}
 }
 
 // Callback for each connection
@@ -25,14 +25,14 @@ type PairMux struct {
 
 // NewBlockingPairMux creates a new PairMux that blocks on writes to full
 // channels.
-func NewBlockingPairMux(src <-chan *RequestResponsePair) PairMux {
-	m := PairMux{src: src, blocking: true, writer: blockingOutputWriter, Finished: make(chan bool, 1)}
+func NewBlockingPairMux(src <-chan *RequestResponsePair) *PairMux {
+	m := &PairMux{src: src, blocking: true, writer: blockingOutputWriter, Finished: make(chan bool, 1)}
 	return m
 }
 
 // NewNonBlockingPairMux creates new PairMux that doesn't block on writes.
-func NewNonBlockingPairMux(src <-chan *RequestResponsePair, timeout time.Duration) PairMux {
-	m := PairMux{src: src, blocking: false, timeout: timeout, Finished: make(chan bool, 1)}
+func NewNonBlockingPairMux(src <-chan *RequestResponsePair, timeout time.Duration) *PairMux {
+	m := &PairMux{src: src, blocking: false, timeout: timeout, Finished: make(chan bool, 1)}
 	if timeout != 0 {
 		m.writer = makeTimeoutOutputWriter(timeout)
 	} else {
@@ -0,0 +1,119 @@
+package httpsource
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerSentEvent is a single event decoded from a text/event-stream
+// response.  ID and Retry carry the last values seen on the stream, as a
+// reconnecting client would use them.  Timestamp is the capture time of the
+// data that completed the event.
+type ServerSentEvent struct {
+	ID        string
+	Event     string
+	Data      string
+	Retry     int
+	Timestamp time.Time
+}
+
+// eventDecoder decodes events from an event stream as described in the
+// HTML Living Standard, section 9.2.
+type eventDecoder struct {
+	r      *bufio.Reader
+	lastID string
+	retry  int
+	skipLF bool
+}
+
+func newEventDecoder(r io.Reader) *eventDecoder {
+	return &eventDecoder{r: bufio.NewReader(r)}
+}
+
+// isEventStream returns true if the response is a text/event-stream.
+func isEventStream(resp *http.Response) bool {
+	mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mt == "text/event-stream"
+}
+
+// Next returns the next complete event.  An event that is interrupted by
+// the end of the stream is discarded and io.EOF returned.
+func (d *eventDecoder) Next() (*ServerSentEvent, error) {
+	ev := &ServerSentEvent{}
+	var data []string
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			if data == nil {
+				// Nothing to dispatch
+				ev = &ServerSentEvent{}
+				continue
+			}
+			ev.ID = d.lastID
+			ev.Retry = d.retry
+			ev.Data = strings.Join(data, "\n")
+			if ev.Event == "" {
+				ev.Event = "message"
+			}
+			return ev, nil
+		}
+		if line[0] == ':' {
+			// Comment
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastID = value
+			}
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil && retry >= 0 {
+				d.retry = retry
+			}
+		}
+	}
+}
+
+// readLine reads a line terminated by CRLF, LF or CR.  A trailing CR is
+// not followed by a peek so that a live stream is never blocked on the
+// next line.
+func (d *eventDecoder) readLine() (string, error) {
+	var line bytes.Buffer
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if d.skipLF {
+			d.skipLF = false
+			if c == '\n' {
+				continue
+			}
+		}
+		switch c {
+		case '\r':
+			d.skipLF = true
+			return line.String(), nil
+		case '\n':
+			return line.String(), nil
+		}
+		line.WriteByte(c)
+	}
+}
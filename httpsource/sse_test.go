@@ -0,0 +1,145 @@
+package httpsource
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/google/gopacket/tcpassembly"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventDecoder(t *testing.T) {
+	stream := "data: a\r\rdata: b\r\ndata: c\n\nevent: ping\nid: 7\ndata\n\n: comment\n\nid: 8\ndata: partial"
+	dec := newEventDecoder(strings.NewReader(stream))
+	expected := []ServerSentEvent{
+		{Event: "message", Data: "a"},
+		{Event: "message", Data: "b\nc"},
+		{Event: "ping", ID: "7", Data: ""},
+	}
+	for _, exp := range expected {
+		ev, err := dec.Next()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		if *ev != exp {
+			t.Errorf("Expected %+v, got %+v.\n", exp, *ev)
+		}
+	}
+	if ev, err := dec.Next(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v, %v.\n", ev, err)
+	}
+}
+
+func TestReadConnectionEventStream(t *testing.T) {
+	reqs, err := os.Open(filepath.Join("testdata", "sse_request.txt"))
+	fatalIfErr(t, err)
+	resps, err := os.Open(filepath.Join("testdata", "sse_response.txt"))
+	fatalIfErr(t, err)
+	var subRecords []*RequestResponsePair
+	conn := HTTPConnection{EventDecoded: func(p *RequestResponsePair) {
+		subRecords = append(subRecords, p)
+	}}
+	conn.readConnection(bufio.NewReader(reqs), bufio.NewReader(resps))
+	if len(conn.Pairs) != 1 {
+		t.Fatalf("Expected 1 pair, got %d.\n", len(conn.Pairs))
+	}
+	pair := conn.Pairs[0]
+	if len(pair.Events) != 2 || len(subRecords) != 2 {
+		t.Fatalf("Expected 2 events, got %d and %d sub-records.\n", len(pair.Events), len(subRecords))
+	}
+	if ev := subRecords[0].Event; ev.ID != "1" || ev.Event != "login" || ev.Data != "{\"user\":\n\"admin\"}" {
+		t.Errorf("Unexpected first event: %+v\n", *ev)
+	}
+	if ev := subRecords[1].Event; ev.ID != "1" || ev.Retry != 3000 || ev.Data != "second" {
+		t.Errorf("Unexpected second event: %+v\n", *ev)
+	}
+	if subRecords[0].Event.Timestamp.IsZero() {
+		t.Errorf("Expected event timestamp to be set.\n")
+	}
+	if subRecords[0].Fingerprint() == subRecords[1].Fingerprint() {
+		t.Errorf("Expected sub-records to have distinct fingerprints.\n")
+	}
+	if !strings.HasSuffix(string(pair.ResponseBody), "data: truncated\n") {
+		t.Errorf("Expected full body, got %q\n", pair.ResponseBody)
+	}
+}
+
+func TestReadConnectionEventStreamTimestamps(t *testing.T) {
+	reqs, err := ioutil.ReadFile(filepath.Join("testdata", "sse_request.txt"))
+	fatalIfErr(t, err)
+	resps, err := ioutil.ReadFile(filepath.Join("testdata", "sse_response.txt"))
+	fatalIfErr(t, err)
+	t0 := time.Unix(1000, 0)
+	req, resp := newConnStream(), newConnStream()
+	req.Reassembled([]tcpassembly.Reassembly{{Bytes: reqs, Seen: t0}})
+	// Each event arrives in its own segment, all before parsing starts
+	first, second := bytes.Index(resps, []byte("id: 1")), bytes.Index(resps, []byte("retry:"))
+	resp.Reassembled([]tcpassembly.Reassembly{{Bytes: resps[:first], Seen: t0.Add(time.Second)}})
+	resp.Reassembled([]tcpassembly.Reassembly{{Bytes: resps[first:second], Seen: t0.Add(2 * time.Second)}})
+	resp.Reassembled([]tcpassembly.Reassembly{{Bytes: resps[second:], Seen: t0.Add(3 * time.Second)}})
+	req.ReassemblyComplete()
+	resp.ReassemblyComplete()
+
+	conn := NewHTTPConnection(connKey{}, func(*HTTPConnection) {})
+	conn.streams = [2]*connStream{req, resp}
+	conn.startReadConnection()
+	if len(conn.Pairs) != 1 || len(conn.Pairs[0].Events) != 2 {
+		t.Fatalf("Expected 1 pair with 2 events, got %d pairs.\n", len(conn.Pairs))
+	}
+	for i, ev := range conn.Pairs[0].Events {
+		if expected := t0.Add(time.Duration(i+2) * time.Second); !ev.Timestamp.Equal(expected) {
+			t.Errorf("Event %d: expected %v, got %v\n", i, expected, ev.Timestamp)
+		}
+	}
+}
+
+func TestReadConnectionEventStreamBounded(t *testing.T) {
+	reqs, err := ioutil.ReadFile(filepath.Join("testdata", "sse_request.txt"))
+	fatalIfErr(t, err)
+	req, resp := newConnStream(), newConnStream()
+	req.Reassembled([]tcpassembly.Reassembly{{Bytes: reqs, Seen: time.Unix(1000, 0)}})
+	req.ReassemblyComplete()
+	resp.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\n\r\n"), Seen: time.Unix(1000, 0)}})
+
+	decoded := make(chan *RequestResponsePair)
+	finished := make(chan *HTTPConnection)
+	conn := NewHTTPConnection(connKey{}, func(c *HTTPConnection) { finished <- c })
+	conn.EventDecoded = func(p *RequestResponsePair) { decoded <- p }
+	conn.streams = [2]*connStream{req, resp}
+	go conn.startReadConnection()
+
+	// Send each event once the previous one is decoded, many times the
+	// limits of the pair, and check the stream keeps little of them
+	event := []byte("data: " + strings.Repeat("x", 500) + "\n\n")
+	n := 2 * maxStreamBody / len(event)
+	maxData, maxMarks := 0, 0
+	for i := 0; i < n; i++ {
+		resp.Reassembled([]tcpassembly.Reassembly{{Bytes: event, Seen: time.Unix(int64(1001+i), 0)}})
+		p := <-decoded
+		if !p.Event.Timestamp.Equal(time.Unix(int64(1001+i), 0)) {
+			t.Fatalf("Event %d: unexpected time %v\n", i, p.Event.Timestamp)
+		}
+		resp.lock.Lock()
+		if len(resp.data) > maxData {
+			maxData = len(resp.data)
+		}
+		if len(resp.marks) > maxMarks {
+			maxMarks = len(resp.marks)
+		}
+		resp.lock.Unlock()
+	}
+	resp.ReassemblyComplete()
+	<-finished
+	if maxData > 2*len(event) || maxMarks > 2 {
+		t.Errorf("Expected the stream to release decoded events, kept up to %d bytes and %d marks\n", maxData, maxMarks)
+	}
+	pair := conn.Pairs[0]
+	if len(pair.Events) != maxStreamEvents || len(pair.ResponseBody) != maxStreamBody {
+		t.Errorf("Expected the pair to keep %d events and %d bytes, got %d and %d\n", maxStreamEvents, maxStreamBody, len(pair.Events), len(pair.ResponseBody))
+	}
+}
@@ -0,0 +1,166 @@
+package httpsource
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/tcpassembly"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// connStream implements tcpassembly.Stream by buffering the reassembled
+// data of one direction of a connection.  Unlike tcpreader.ReaderStream it
+// never blocks the assembler, so the data can be parsed while the connection
+// is still open.  Data every reader has released is dropped, so that streams
+// that stay open for long, such as event streams, do not grow without bound.
+type connStream struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	base    int
+	data    []byte
+	marks   []seenMark
+	readers []*streamReader
+	closed  bool
+	netFlow gopacket.Flow
+	tcpFlow gopacket.Flow
+}
+
+// seenMark records the capture time of the data starting at offset.
+type seenMark struct {
+	offset int
+	seen   time.Time
+}
+
+// streamReader reads a connStream from the beginning, blocking until more
+// data is available or the stream is complete.  Offsets are from the start
+// of the stream, including any data since dropped.
+type streamReader struct {
+	s        *connStream
+	offset   int
+	released int
+}
+
+func newConnStream() *connStream {
+	s := &connStream{}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// srcAddr returns the address this direction of the connection was sent
+// from, or nil if the stream has no flows.
+func (s *connStream) srcAddr() *net.TCPAddr {
+	ip, port := s.netFlow.Src().Raw(), s.tcpFlow.Src().Raw()
+	if (len(ip) != net.IPv4len && len(ip) != net.IPv6len) || len(port) != 2 {
+		return nil
+	}
+	return &net.TCPAddr{IP: net.IP(ip), Port: int(binary.BigEndian.Uint16(port))}
+}
+
+// Reassembled appends the reassembled data to the buffer.
+func (s *connStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range reassembly {
+		if len(r.Bytes) == 0 {
+			continue
+		}
+		s.marks = append(s.marks, seenMark{s.base + len(s.data), r.Seen})
+		s.data = append(s.data, r.Bytes...)
+	}
+	s.cond.Broadcast()
+}
+
+// ReassemblyComplete marks the stream as finished.
+func (s *connStream) ReassemblyComplete() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// SeenAt returns the capture time of the byte at offset.
+func (s *connStream) SeenAt(offset int) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := sort.Search(len(s.marks), func(i int) bool {
+		return s.marks[i].offset > offset
+	})
+	if i == 0 {
+		return time.Time{}
+	}
+	return s.marks[i-1].seen
+}
+
+// NewReader returns a reader positioned at the start of the stream.  No
+// data is dropped until every reader has released it.
+func (s *connStream) NewReader() *streamReader {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := &streamReader{s: s}
+	s.readers = append(s.readers, r)
+	return r
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for r.offset >= s.base+len(s.data) && !s.closed {
+		s.cond.Wait()
+	}
+	if r.offset >= s.base+len(s.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[r.offset-s.base:])
+	r.offset += n
+	return n, nil
+}
+
+// Release tells the stream that the reader no longer needs the data before
+// offset, nor its capture times, which must already have been read.
+func (r *streamReader) Release(offset int) {
+	s := r.s
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if offset > r.offset {
+		offset = r.offset
+	}
+	if offset <= r.released {
+		return
+	}
+	r.released = offset
+	for _, other := range s.readers {
+		if other.released < offset {
+			offset = other.released
+		}
+	}
+	if offset <= s.base {
+		return
+	}
+	s.data = compactSlice(s.data, offset-s.base)
+	s.base = offset
+	// Keep the mark covering offset
+	i := sort.Search(len(s.marks), func(i int) bool {
+		return s.marks[i].offset > offset
+	})
+	if i > 1 {
+		s.marks = append([]seenMark(nil), s.marks[i-1:]...)
+	}
+}
+
+// compactSlice drops the first n bytes, copying the rest once they are the
+// smaller part so that the dropped data can be freed.
+func compactSlice(data []byte, n int) []byte {
+	if n < len(data)-n {
+		return data[n:]
+	}
+	return append([]byte(nil), data[n:]...)
+}
+
+// Seen returns the capture time of the most recently read data.
+func (r *streamReader) Seen() time.Time {
+	return r.s.SeenAt(r.offset - 1)
+}
@@ -0,0 +1,45 @@
+package httpsource
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestConnStream(t *testing.T) {
+	s := newConnStream()
+	r := s.NewReader()
+	t0 := time.Unix(1000, 0)
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("GET "), Seen: t0}})
+	s.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte("/"), Seen: t0.Add(time.Second)}})
+	s.ReassemblyComplete()
+	if data := <-done; string(data) != "GET /" {
+		t.Fatalf("Expected \"GET /\", got %q\n", data)
+	}
+	if seen := s.SeenAt(3); !seen.Equal(t0) {
+		t.Errorf("Expected %v at offset 3, got %v\n", t0, seen)
+	}
+	if seen := r.Seen(); !seen.Equal(t0.Add(time.Second)) {
+		t.Errorf("Expected last read at %v, got %v\n", t0.Add(time.Second), seen)
+	}
+}
+
+func TestConnStreamSrcAddr(t *testing.T) {
+	s := newConnStream()
+	if s.srcAddr() != nil {
+		t.Errorf("Expected no address without flows.\n")
+	}
+	s.netFlow = gopacket.NewFlow(layers.EndpointIPv4, []byte{192, 0, 2, 10}, []byte{192, 0, 2, 1})
+	s.tcpFlow = gopacket.NewFlow(layers.EndpointTCPPort, []byte{0xc7, 0x38}, []byte{0, 80})
+	if addr := s.srcAddr(); addr == nil || addr.String() != "192.0.2.10:51000" {
+		t.Errorf("Unexpected address %v\n", addr)
+	}
+}
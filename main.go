@@ -13,16 +13,52 @@ func main() {
 	// Setup config
 	cfg := config.Config{}
 	cfg.Init()
-	if err := cfg.Valid(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
 
 	// Set all loggers to the same
 	httpsource.SetLogger(cfg.Logger)
 	output.SetLogger(cfg.Logger)
 	rules.SetLogger(cfg.Logger)
 
+	// Load descriptors for gRPC decoding
+	if err := rules.LoadProtoDescriptors(cfg.ProtoDescriptors...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Load keys for verifying JWTs
+	if err := rules.LoadJWKS(cfg.JWKS); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Load named lists used by rules
+	if err := rules.LoadLists(cfg.Lists); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Add rules from other formats
+	if err := cfg.LoadRuleFiles(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Add the enabled built-in detectors
+	if err := cfg.AddDetectors(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Check the config, including compiling every rule
+	if err := cfg.Valid(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cfg.CheckOnly {
+		fmt.Printf("%s: OK\n", cfg.Filename)
+		return
+	}
+
 	// Setup sources
 	source := httpsource.NewHTTPSource()
 	source.ConvertConnectionsToPairs()
@@ -45,17 +81,21 @@ func main() {
 		return
 	}
 
-	// Create rule mux
-	// TODO: provide option on type of Mux
-	rulemux := httpsource.NewBlockingPairMux(source.Pairs)
-
 	// Setup all rules
-	ruleEngine := rules.NewRuleEngine(cfg.Rules, rulemux)
+	ruleEngine, matches, err := newRuleEngine(&cfg, source.Pairs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	// Setup outputs
-	outputEngine := output.NewOutputEngine(ruleEngine.Matches)
+	outputEngine := output.NewOutputEngine(matches)
 	for _, o := range cfg.Outputs {
-		outputEngine.AddOutput(o.Name, o.Options)
+		filter := output.Filter{Rules: o.Rules, Tags: o.Tags}
+		if err := outputEngine.AddOutput(o.Name, o.Options, filter); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
 	// Start all the working parts
@@ -67,3 +107,28 @@ func main() {
 	ruleEngine.WaitUntilFinished()
 	outputEngine.WaitUntilFinished()
 }
+
+// ruleEngine is implemented by both rules.RuleEngine and rules.PoolEngine.
+type ruleEngine interface {
+	Start()
+	WaitUntilFinished()
+}
+
+// Create the engine chosen by the config: one goroutine per rule fed by a
+// mux (the default), or a pool of workers evaluating every rule per pair.
+func newRuleEngine(cfg *config.Config, pairs <-chan *httpsource.RequestResponsePair) (ruleEngine, <-chan *rules.Match, error) {
+	if cfg.Engine == "pool" {
+		e, err := rules.NewPoolEngine(cfg.Rules, pairs, cfg.Workers)
+		if err != nil {
+			return nil, nil, err
+		}
+		return e, e.Matches, nil
+	}
+	// TODO: provide option on type of Mux
+	rulemux := httpsource.NewBlockingPairMux(pairs)
+	e, err := rules.NewRuleEngine(cfg.Rules, rulemux)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, e.Matches, nil
+}
@@ -2,24 +2,45 @@ package output
 
 import (
 	"fmt"
-	"github.com/Matir/httpwatch/httpsource"
+	"github.com/Matir/httpwatch/rules"
 	"log"
 	"os"
+	"path"
 	"sync"
 )
 
 var logger = log.New(os.Stderr, "output: ", log.Lshortfile|log.Ltime)
 
+// OutputSink receives each Match, including the rules that matched, their
+// severity and tags.
 type OutputSink interface {
-	Write(*httpsource.RequestResponsePair)
+	Write(*rules.Match)
 }
 
+// Filter selects the matches an output receives.  An empty Filter receives
+// every match; otherwise a match is received if any of its rules has a name
+// matching one of Rules (which may be patterns such as creds-*) or any of
+// its tags is in Tags.
+type Filter struct {
+	Rules []string
+	Tags  []string
+}
+
+// OutputEngine copies each Match from its input to the outputs whose filter
+// it passes.
 type OutputEngine struct {
-	mux      httpsource.PairMux
+	input    <-chan *rules.Match
+	outputs  []filteredOutput
 	finished chan bool
 	allDone  chan bool
 	lock     sync.Mutex
 	active   int
+	started  bool
+}
+
+type filteredOutput struct {
+	filter Filter
+	dst    chan *rules.Match
 }
 
 type OutputSinkBuilder func(options map[string]string) OutputSink
@@ -33,25 +54,61 @@ func GetOutputSink(name string, options map[string]string) OutputSink {
 	return nil
 }
 
-func NewOutputEngine(input <-chan *httpsource.RequestResponsePair) OutputEngine {
-	e := OutputEngine{mux: httpsource.NewBlockingPairMux(input)}
+func NewOutputEngine(input <-chan *rules.Match) *OutputEngine {
+	e := &OutputEngine{input: input}
 	e.finished = make(chan bool)
 	e.allDone = make(chan bool, 1)
 	return e
 }
 
-func (e *OutputEngine) AddOutput(name string, options map[string]string) error {
+// Valid checks the rule name patterns are well formed.
+func (f Filter) Valid() error {
+	for _, pattern := range f.Rules {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid rule pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Allows returns true if the match passes the filter.
+func (f Filter) Allows(m *rules.Match) bool {
+	if len(f.Rules) == 0 && len(f.Tags) == 0 {
+		return true
+	}
+	for _, name := range m.Rules {
+		for _, pattern := range f.Rules {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	for _, tag := range f.Tags {
+		if m.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddOutput adds an output of the named type, which receives the matches
+// that pass the filter.
+func (e *OutputEngine) AddOutput(name string, options map[string]string, filter Filter) error {
+	if err := filter.Valid(); err != nil {
+		return err
+	}
 	e.lock.Lock()
 	defer e.lock.Unlock()
 	o := GetOutputSink(name, options)
 	if o == nil {
 		return fmt.Errorf("Invalid output type %s", name)
 	}
-	c := e.mux.AddOutput("output:"+name, 20)
+	c := make(chan *rules.Match, 20)
+	e.outputs = append(e.outputs, filteredOutput{filter, c})
 	e.active++
 	go func() {
-		for pair := range c {
-			o.Write(pair)
+		for m := range c {
+			o.Write(m)
 		}
 		e.finished <- true
 	}()
@@ -59,7 +116,13 @@ func (e *OutputEngine) AddOutput(name string, options map[string]string) error {
 }
 
 func (e *OutputEngine) Start() {
-	e.mux.Start()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.started {
+		return
+	}
+	e.started = true
+	go e.copyMatches()
 	go func() {
 		for _ = range e.finished {
 			logger.Printf("Output finished, %d active...\n", e.active)
@@ -79,6 +142,26 @@ func (e *OutputEngine) Start() {
 	}()
 }
 
+// Copy each match to the outputs it is routed to, closing them once the
+// input is done.
+func (e *OutputEngine) copyMatches() {
+	for m := range e.input {
+		e.lock.Lock()
+		outputs := e.outputs[:]
+		e.lock.Unlock()
+		for _, o := range outputs {
+			if o.filter.Allows(m) {
+				o.dst <- m
+			}
+		}
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, o := range e.outputs {
+		close(o.dst)
+	}
+}
+
 func (e *OutputEngine) WaitUntilFinished() {
 	<-e.allDone
 }
@@ -2,8 +2,9 @@ package output
 
 import (
 	"fmt"
-	"github.com/Matir/httpwatch/httpsource"
+	"github.com/Matir/httpwatch/rules"
 	"os"
+	"strings"
 )
 
 type requestSink struct {
@@ -15,8 +16,15 @@ func makeRequestSink(_ map[string]string) OutputSink {
 	return &requestSink{os.Stdout}
 }
 
-func (s *requestSink) Write(pair *httpsource.RequestResponsePair) {
-	fmt.Fprintf(s.fp, "%s %s\n", pair.Request.Method, pair.Request.URL.String())
+func (s *requestSink) Write(m *rules.Match) {
+	line := fmt.Sprintf("%s %s [%s]", m.Pair.Request.Method, m.Pair.Request.URL.String(), strings.Join(m.Rules, ", "))
+	if m.Severity != "" {
+		line += " " + m.Severity
+	}
+	if len(m.Tags) > 0 {
+		line += " (" + strings.Join(m.Tags, ", ") + ")"
+	}
+	fmt.Fprintln(s.fp, line)
 }
 
 func init() {
@@ -0,0 +1,127 @@
+package rules
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ahoCorasick finds every occurrence of a set of patterns in a single pass
+// over the text.
+type ahoCorasick struct {
+	patterns   []string
+	ignoreCase bool
+	next       []map[byte]int
+	fail       []int
+	out        [][]int
+}
+
+// Automatons are shared by every rule with the same patterns.
+var automatons = struct {
+	sync.Mutex
+	m map[string]*ahoCorasick
+}{m: make(map[string]*ahoCorasick)}
+
+// sharedAutomaton returns the automaton for the patterns, building it the
+// first time they are used.
+func sharedAutomaton(patterns []string, ignoreCase bool) *ahoCorasick {
+	key := strings.Join(patterns, "\x00")
+	if ignoreCase {
+		key = "i\x00" + key
+	}
+	automatons.Lock()
+	defer automatons.Unlock()
+	if ac, ok := automatons.m[key]; ok {
+		return ac
+	}
+	ac := newAhoCorasick(patterns, ignoreCase)
+	automatons.m[key] = ac
+	return ac
+}
+
+func newAhoCorasick(patterns []string, ignoreCase bool) *ahoCorasick {
+	ac := &ahoCorasick{patterns: patterns, ignoreCase: ignoreCase}
+	ac.addState()
+	for i, p := range patterns {
+		if p == "" {
+			continue
+		}
+		if ignoreCase {
+			p = strings.ToLower(p)
+		}
+		state := 0
+		for j := 0; j < len(p); j++ {
+			n, ok := ac.next[state][p[j]]
+			if !ok {
+				n = ac.addState()
+				ac.next[state][p[j]] = n
+			}
+			state = n
+		}
+		ac.out[state] = append(ac.out[state], i)
+	}
+
+	// Breadth first, so each failure state is complete before it is used
+	queue := []int{}
+	for _, n := range ac.next[0] {
+		queue = append(queue, n)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, n := range ac.next[state] {
+			f := ac.fail[state]
+			for {
+				if fn, ok := ac.next[f][c]; ok {
+					ac.fail[n] = fn
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = ac.fail[f]
+			}
+			ac.out[n] = append(ac.out[n], ac.out[ac.fail[n]]...)
+			queue = append(queue, n)
+		}
+	}
+	return ac
+}
+
+func (ac *ahoCorasick) addState() int {
+	ac.next = append(ac.next, make(map[byte]int))
+	ac.fail = append(ac.fail, 0)
+	ac.out = append(ac.out, nil)
+	return len(ac.next) - 1
+}
+
+// find returns the indices of the patterns occurring in text, in order.
+// Empty patterns are ignored.
+func (ac *ahoCorasick) find(text string) []int {
+	if ac.ignoreCase {
+		text = strings.ToLower(text)
+	}
+	found := make(map[int]bool)
+	state := 0
+	for i := 0; i < len(text); i++ {
+		for {
+			if n, ok := ac.next[state][text[i]]; ok {
+				state = n
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = ac.fail[state]
+		}
+		for _, p := range ac.out[state] {
+			found[p] = true
+		}
+	}
+	indices := make([]int, 0, len(found))
+	for p := range found {
+		indices = append(indices, p)
+	}
+	sort.Ints(indices)
+	return indices
+}
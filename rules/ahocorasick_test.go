@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAhoCorasick(t *testing.T) {
+	ac := newAhoCorasick([]string{"he", "she", "his", "hers", "", "usher"}, false)
+	tests := []struct {
+		text  string
+		found []int
+	}{
+		{"ushers", []int{0, 1, 3, 5}},
+		{"this", []int{2}},
+		{"h", []int{}},
+		{"", []int{}},
+		{"SHE", []int{}},
+	}
+	for _, test := range tests {
+		found := ac.find(test.text)
+		if len(found) != len(test.found) {
+			t.Errorf("%s: expected %v, got %v\n", test.text, test.found, found)
+			continue
+		}
+		for i := range found {
+			if found[i] != test.found[i] {
+				t.Errorf("%s: expected %v, got %v\n", test.text, test.found, found)
+				break
+			}
+		}
+	}
+	if found := newAhoCorasick([]string{"Secret"}, true).find("TOP SECRET"); len(found) != 1 {
+		t.Errorf("Expected a case-insensitive match, got %v\n", found)
+	}
+}
+
+func TestContainsAnyEvaluator(t *testing.T) {
+	body := `{"password": "hunter2", "api_key": "AKIA0000"}`
+	req, _ := http.NewRequest("POST", "http://example.com/login", nil)
+	req.Header.Add("X-Debug", "trace")
+	req.Header.Add("X-Debug", "Internal-Only")
+	pair := &httpsource.RequestResponsePair{Request: req, RequestBody: []byte(body)}
+	keywords := []string{"password", "api_key", "ssn", "AKIA"}
+
+	a := Rule{Name: "a", Operator: "contains-any", Field: "request.body", Values: keywords}
+	b := Rule{Name: "b", Expr: `request.body contains-any [password, api_key, ssn, AKIA]`}
+	for _, r := range []*Rule{&a, &b} {
+		if err := r.Compile(); err != nil {
+			t.Fatalf("Unable to compile: %v\n", err)
+		}
+		if !r.Eval(pair) {
+			t.Errorf("Expected %s to match.\n", r.Name)
+		}
+	}
+	if a.evaluator.(*ContainsAnyEvaluator).ac != b.evaluator.(*ContainsAnyEvaluator).ac {
+		t.Errorf("Expected rules with the same patterns to share an automaton.\n")
+	}
+
+	// Both rules share one scan of the field per pair
+	calls := 0
+	counting := FieldGetter(func(p *httpsource.RequestResponsePair) ([]string, error) {
+		calls++
+		return []string{body}, nil
+	})
+	fresh := &httpsource.RequestResponsePair{}
+	for _, r := range []*Rule{&a, &b} {
+		e := r.evaluator.(*ContainsAnyEvaluator)
+		e.getter = &counting
+		e.Eval(fresh)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 scan, got %d\n", calls)
+	}
+
+	m := NewMatch(&a, pair)
+	if !equalValues(m.Metadata["contains-any"], []string{"password", "api_key", "AKIA"}) {
+		t.Errorf("Unexpected patterns %v\n", m.Metadata["contains-any"])
+	}
+	if !equalValues(m.Values["request.body"], []string{body}) {
+		t.Errorf("Unexpected values %v\n", m.Values)
+	}
+
+	tests := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{Rule{Operator: "contains-any", Field: "request.header.x-debug", Values: []string{"internal"}}, false},
+		{Rule{Operator: "contains-any-i", Field: "request.header.x-debug", Values: []string{"internal"}}, true},
+		{Rule{Operator: "contains-any-i", Field: "request.header.x-debug", Values: []string{"internal", "TRACE"}, Quantifier: "all"}, true},
+		{Rule{Operator: "contains-any", Field: "request.header.x-debug", Values: []string{"trace"}, Quantifier: "all"}, false},
+		{Rule{Operator: "contains-any", Field: "request.body", Value: "ssn"}, false},
+	}
+	for _, test := range tests {
+		e, err := BuildEvaluator(&test.rule)
+		if err != nil {
+			t.Fatalf("Unable to build evaluator: %v\n", err)
+		}
+		if res := e.Eval(pair); res != test.expected {
+			t.Errorf("%s %s %v: expected %v, got %v\n", test.rule.Field, test.rule.Operator, test.rule.Values, test.expected, res)
+		}
+	}
+	if _, err := BuildEvaluator(&Rule{Operator: "contains-any", Field: "request.body"}); err == nil {
+		t.Errorf("Expected an error without patterns.\n")
+	}
+}
+
+func TestContainsAnyCookie(t *testing.T) {
+	r := Rule{Operator: "contains-any", Field: "request.cookie.x", Values: []string{"admin", "root"}}
+	if err := r.Compile(); err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Add("Cookie", "x=role-admin; y=root")
+	pair := &httpsource.RequestResponsePair{Request: req}
+	// The cookies are parsed within the scan, both memoized
+	done := make(chan bool)
+	go func() {
+		done <- r.Eval(pair)
+	}()
+	select {
+	case res := <-done:
+		if !res {
+			t.Errorf("Expected a match.\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Evaluation did not finish.\n")
+	}
+}
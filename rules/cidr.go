@@ -0,0 +1,75 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseIP accepts an address as found in fields such as X-Forwarded-For or
+// Host: a bare IPv4 or IPv6 address, optionally bracketed or with a port.
+// Hostnames are not resolved.
+func parseIP(val string) net.IP {
+	val = strings.TrimSpace(val)
+	if ip := net.ParseIP(strings.Trim(val, "[]")); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(val); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// parsePrefixes parses IPv4/IPv6 prefixes, treating a bare address as a
+// single host.
+func parsePrefixes(vals []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range vals {
+		v = strings.TrimSpace(v)
+		if !strings.ContainsRune(v, '/') {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid prefix: %s", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid prefix: %s", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Build getters for the client.* and server.* fields
+func buildAddrGetter(entity, field string) (FieldGetter, error) {
+	var format func(addr *net.TCPAddr) string
+	switch field {
+	case "ip":
+		format = func(addr *net.TCPAddr) string { return addr.IP.String() }
+	case "port":
+		format = func(addr *net.TCPAddr) string { return strconv.Itoa(addr.Port) }
+	default:
+		return nil, fmt.Errorf("Unknown field: %s", field)
+	}
+
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		addr := pair.ClientAddr
+		if entity == "server" {
+			addr = pair.ServerAddr
+		}
+		if addr == nil {
+			return nil, errors.New("No address for connection")
+		}
+		return []string{format(addr)}, nil
+	}, nil
+}
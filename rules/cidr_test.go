@@ -0,0 +1,101 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestCIDREvaluator(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://169.254.169.254/latest/meta-data/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.1.2.3")
+	pair := &httpsource.RequestResponsePair{
+		Request:    req,
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51000},
+		ServerAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+	}
+	tests := []struct {
+		field, quantifier string
+		values            []string
+		expected          bool
+	}{
+		{"client.ip", "", []string{"192.0.2.0/24"}, true},
+		{"client.ip", "", []string{"10.0.0.0/8"}, false},
+		{"client.ip", "none", []string{"10.0.0.0/8", "172.16.0.0/12"}, true},
+		{"server.ip", "", []string{"2001:db8::/32"}, true},
+		{"server.ip", "", []string{"2001:db8::1"}, true},
+		{"request.host", "", []string{"169.254.169.254"}, true},
+		{"request.header.x-forwarded-for", "", []string{"10.0.0.0/8"}, true},
+		{"request.header.x-forwarded-for", "all", []string{"10.0.0.0/8"}, false},
+		{"request.method", "", []string{"0.0.0.0/0", "::/0"}, false},
+	}
+	for _, test := range tests {
+		r := Rule{Operator: "in-cidr", Field: test.field, Values: test.values, Quantifier: test.quantifier}
+		e, err := BuildEvaluator(&r)
+		if err != nil {
+			t.Fatalf("Unable to build evaluator: %v\n", err)
+		}
+		if res := e.Eval(pair); res != test.expected {
+			t.Errorf("%s in-cidr %v: expected %v, got %v\n", test.field, test.values, test.expected, res)
+		}
+	}
+	for _, bad := range []Rule{
+		{Operator: "in-cidr", Field: "client.ip"},
+		{Operator: "in-cidr", Field: "client.ip", Value: "10.0.0.0/33"},
+		{Operator: "in-cidr", Field: "client.ip", Value: "example.com"},
+		{Operator: "in-cidr", Field: "client.ip", Value: "@missing"},
+	} {
+		if _, err := BuildEvaluator(&bad); err == nil {
+			t.Errorf("Expected error for in-cidr %q\n", bad.Value)
+		}
+	}
+}
+
+func TestAddrGetters(t *testing.T) {
+	pair := &httpsource.RequestResponsePair{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51000},
+		ServerAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	}
+	checkGetters(t, pair, []getterTest{
+		{"client.ip", []string{"192.0.2.10"}},
+		{"client.port", []string{"51000"}},
+		{"server.ip", []string{"2001:db8::1"}},
+		{"server.port", []string{"443"}},
+	})
+	g, _ := buildGetter("client.ip")
+	if _, err := g(&httpsource.RequestResponsePair{}); err == nil {
+		t.Errorf("Expected an error without addresses.\n")
+	}
+}
+
+func TestNamedLists(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "internal.txt")
+	list := "# RFC 1918\n10.0.0.0/8\n\n172.16.0.0/12\n192.168.0.0/16\n"
+	if err := ioutil.WriteFile(fname, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadLists(map[string]string{"internal": fname}); err != nil {
+		t.Fatalf("Unable to load list: %v\n", err)
+	}
+	defer delete(namedLists, "internal")
+	if err := LoadLists(map[string]string{"missing": fname + ".missing"}); err == nil {
+		t.Errorf("Expected error loading a missing file.\n")
+	}
+
+	pair := &httpsource.RequestResponsePair{ClientAddr: &net.TCPAddr{IP: net.ParseIP("172.20.1.1")}}
+	r := Rule{Operator: "in-cidr", Field: "client.ip", Value: "@internal"}
+	e, err := BuildEvaluator(&r)
+	if err != nil {
+		t.Fatalf("Unable to build evaluator: %v\n", err)
+	}
+	if !e.Eval(pair) {
+		t.Errorf("Expected 172.20.1.1 to be in @internal.\n")
+	}
+	r = Rule{Operator: "in", Field: "client.ip", Values: []string{"@internal", "172.20.1.1"}}
+	if e, err = BuildEvaluator(&r); err != nil || !e.Eval(pair) {
+		t.Errorf("Expected in to accept a list and a value (%v).\n", err)
+	}
+}
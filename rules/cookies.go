@@ -0,0 +1,99 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// getRequestCookies parses the Cookie headers once per pair.
+func getRequestCookies(pair *httpsource.RequestResponsePair) []*http.Cookie {
+	return pair.Memoize("cookies", func() interface{} {
+		if pair.Request == nil {
+			return []*http.Cookie(nil)
+		}
+		return pair.Request.Cookies()
+	}).([]*http.Cookie)
+}
+
+// getResponseCookies parses the Set-Cookie headers once per pair.
+func getResponseCookies(pair *httpsource.RequestResponsePair) []*http.Cookie {
+	return pair.Memoize("setcookies", func() interface{} {
+		if pair.Response == nil {
+			return []*http.Cookie(nil)
+		}
+		return pair.Response.Cookies()
+	}).([]*http.Cookie)
+}
+
+// Get the values of a cookie sent with the request
+func buildCookieGetter(name string) (FieldGetter, error) {
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		var vals []string
+		for _, c := range getRequestCookies(pair) {
+			if c.Name == name {
+				vals = append(vals, c.Value)
+			}
+		}
+		return vals, nil
+	}, nil
+}
+
+// Get the cookies set by the response, either as <name> for the value or
+// <name>.<attribute> for one of its attributes.
+func buildSetCookieGetter(attribute string) (FieldGetter, error) {
+	name, attr := attribute, "value"
+	if i := strings.LastIndexByte(attribute, '.'); i != -1 {
+		switch attribute[i+1:] {
+		case "value", "secure", "httponly", "samesite", "domain", "path", "expires", "maxage":
+			name, attr = attribute[:i], attribute[i+1:]
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("No cookie name in %s", attribute)
+	}
+	var getter func(c *http.Cookie) string
+	switch attr {
+	case "value":
+		getter = func(c *http.Cookie) string { return c.Value }
+	case "secure":
+		getter = func(c *http.Cookie) string { return strconv.FormatBool(c.Secure) }
+	case "httponly":
+		getter = func(c *http.Cookie) string { return strconv.FormatBool(c.HttpOnly) }
+	case "samesite":
+		getter = sameSiteString
+	case "domain":
+		getter = func(c *http.Cookie) string { return c.Domain }
+	case "path":
+		getter = func(c *http.Cookie) string { return c.Path }
+	case "expires":
+		getter = func(c *http.Cookie) string { return c.RawExpires }
+	case "maxage":
+		getter = func(c *http.Cookie) string { return strconv.Itoa(c.MaxAge) }
+	}
+
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		var vals []string
+		for _, c := range getResponseCookies(pair) {
+			if c.Name == name {
+				vals = append(vals, getter(c))
+			}
+		}
+		return vals, nil
+	}, nil
+}
+
+// The SameSite attribute as sent, or empty if it was absent.
+func sameSiteString(c *http.Cookie) string {
+	switch c.SameSite {
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteNoneMode:
+		return "None"
+	}
+	return ""
+}
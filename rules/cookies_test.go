@@ -0,0 +1,33 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"net/http"
+	"testing"
+)
+
+func TestCookieGetters(t *testing.T) {
+	req, _ := requestFromURI("http://example.com/")
+	req.Header.Add("Cookie", "session=abc123; theme=dark")
+	resp := &http.Response{Header: make(http.Header)}
+	resp.Header.Add("Set-Cookie", "session=xyz; Domain=example.com; Path=/; Secure; HttpOnly; SameSite=Strict")
+	resp.Header.Add("Set-Cookie", "tracking.id=42; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Max-Age=60")
+	pair := &httpsource.RequestResponsePair{Request: req, Response: resp}
+	checkGetters(t, pair, []getterTest{
+		{"request.cookie.session", []string{"abc123"}},
+		{"request.cookie.theme", []string{"dark"}},
+		{"request.cookie.missing", nil},
+		{"response.setcookie.session", []string{"xyz"}},
+		{"response.setcookie.session.secure", []string{"true"}},
+		{"response.setcookie.session.httponly", []string{"true"}},
+		{"response.setcookie.session.samesite", []string{"Strict"}},
+		{"response.setcookie.session.domain", []string{"example.com"}},
+		{"response.setcookie.session.path", []string{"/"}},
+		{"response.setcookie.tracking.id", []string{"42"}},
+		{"response.setcookie.tracking.id.secure", []string{"false"}},
+		{"response.setcookie.tracking.id.samesite", []string{""}},
+		{"response.setcookie.tracking.id.expires", []string{"Wed, 21 Oct 2026 07:28:00 GMT"}},
+		{"response.setcookie.tracking.id.maxage", []string{"60"}},
+		{"response.setcookie.missing.secure", nil},
+	})
+}
@@ -0,0 +1,174 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"math"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Detectors are built-in checks for sensitive data, such as credentials,
+// each enabled as a rule of its own by DetectorRules.  They report only
+// redacted or masked evidence of what they found, and how much, as metadata
+// under their name, and never the values of the fields they inspect.
+
+// detector finds sensitive data in a value, returning redacted evidence of
+// each finding.
+type detector struct {
+	name     string
+	severity string
+	fields   []string
+	find     func(val string) []string
+}
+
+// Detectors by name, such as secret.aws-access-key
+var detectors = make(map[string]*detector)
+
+func registerDetector(d *detector) {
+	detectors[d.name] = d
+}
+
+// DetectorNames returns the names of the built-in detectors, sorted.
+func DetectorNames() []string {
+	names := make([]string, 0, len(detectors))
+	for name := range detectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DetectorRules returns a rule for each detector enabled by the patterns,
+// such as secret.* or pii.credit-card.  A pattern starting with ! disables
+// the detectors it matches instead, and later patterns take precedence.  Each
+// rule is named after its detector, and tagged with its category.
+func DetectorRules(patterns []string) ([]Rule, error) {
+	enabled := make(map[string]bool)
+	for _, p := range patterns {
+		disable := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		found := false
+		for name := range detectors {
+			ok, err := path.Match(p, name)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid detector pattern %s: %v", p, err)
+			}
+			if ok {
+				enabled[name] = !disable
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No detectors match %s", p)
+		}
+	}
+	var rules []Rule
+	for _, name := range DetectorNames() {
+		if !enabled[name] {
+			continue
+		}
+		d := detectors[name]
+		var leaves []Rule
+		for _, f := range d.fields {
+			leaves = append(leaves, Rule{Operator: "detect", Field: f, Value: name})
+		}
+		r := combineRules("or", leaves)
+		r.Name, r.Severity = name, d.severity
+		if i := strings.IndexByte(name, '.'); i != -1 {
+			r.Tags = []string{name[:i]}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// DetectorEvaluator runs a detector over each value of a field.  It does not
+// report the values themselves, only the detector's redacted evidence.
+type DetectorEvaluator struct {
+	abstractEvaluator
+	detector *detector
+}
+
+func (e *DetectorEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	scan := e.scan(pair)
+	if scan.err != nil {
+		return false
+	}
+	matched := 0
+	for _, found := range scan.found {
+		if len(found) > 0 {
+			matched++
+		}
+	}
+	return e.applyQuantifier(matched, len(scan.found))
+}
+
+// Evidence reported for each field is limited to a few samples
+const maxDetectorSamples = 5
+
+// Samples of the evidence found in the values of the field, under the name
+// of the detector, and the number of distinct findings as field=count under
+// the name with .count added.
+func (e *DetectorEvaluator) metadata(pair *httpsource.RequestResponsePair) map[string][]string {
+	var evidence []string
+	for _, found := range e.scan(pair).found {
+		evidence = appendUnique(evidence, found...)
+	}
+	if len(evidence) == 0 {
+		return nil
+	}
+	count := fmt.Sprintf("%s=%d", e.rule.Field, len(evidence))
+	if len(evidence) > maxDetectorSamples {
+		evidence = evidence[:maxDetectorSamples]
+	}
+	return map[string][]string{e.detector.name: evidence, e.detector.name + ".count": {count}}
+}
+
+// detectorScan holds the evidence found in each value of a field.
+type detectorScan struct {
+	found [][]string
+	err   error
+}
+
+func (e *DetectorEvaluator) scan(pair *httpsource.RequestResponsePair) *detectorScan {
+	key := fmt.Sprintf("detect.%s.%s", e.detector.name, e.rule.Field)
+	return pair.Memoize(key, func() interface{} {
+		vals, err := (*e.getter)(pair)
+		scan := &detectorScan{err: err}
+		for _, v := range vals {
+			scan.found = append(scan.found, e.detector.find(v))
+		}
+		return scan
+	}).(*detectorScan)
+}
+
+// shannonEntropy returns the entropy of s in bits per byte.  Random tokens
+// score highly, while words and placeholders such as xxxx score low.
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// redact keeps only enough of a secret to recognize it: the first four and
+// last two characters of longer values.
+func redact(s string) string {
+	if len(s) < 12 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:4] + "****" + s[len(s)-2:]
+}
@@ -2,6 +2,7 @@ package rules
 
 import (
 	"github.com/Matir/httpwatch/httpsource"
+	"strings"
 	"sync"
 )
 
@@ -10,35 +11,43 @@ type ruleContainer struct {
 	input <-chan *httpsource.RequestResponsePair
 }
 
-// RuleEngine manages running RequestResponsePairs through the Rules defined
+// RuleEngine manages running RequestResponsePairs through the Rules defined,
+// sending a Match to Matches each time a rule matches a pair.
 type RuleEngine struct {
-	Matches    <-chan *httpsource.RequestResponsePair
+	Matches    <-chan *Match
 	rules      []ruleContainer
-	mux        httpsource.PairMux
+	mux        *httpsource.PairMux
 	running    bool
 	lock       sync.Mutex
-	rawMatches chan *httpsource.RequestResponsePair
+	rawMatches chan *Match
 	finished   chan *ruleContainer
 	allDone    chan bool
 }
 
 // NewRuleEngine creates a RuleEngine for the given set of Rules and the PairMux
-// given.
-func NewRuleEngine(rules []Rule, mux httpsource.PairMux) *RuleEngine {
+// given.  Every rule is compiled first, and any errors are returned together
+// as a RuleErrors.
+func NewRuleEngine(rules []Rule, mux *httpsource.PairMux) (*RuleEngine, error) {
+	if err := CompileRules(rules); err != nil {
+		return nil, err
+	}
 	r := &RuleEngine{mux: mux}
-	r.rawMatches = make(chan *httpsource.RequestResponsePair, 100)
+	r.rawMatches = make(chan *Match, 100)
 	r.Matches = makeDeduplicatingChannel(r.rawMatches)
 	r.finished = make(chan *ruleContainer, len(rules)*2)
 	r.allDone = make(chan bool)
 	for _, rule := range rules {
 		r.AddRule(rule)
 	}
-	return r
+	return r, nil
 }
 
-// AddRule adds a Rule to the RuleEngine, and starts it if the RuleEngine is
-// already running.
-func (r *RuleEngine) AddRule(rule Rule) {
+// AddRule compiles a Rule and adds it to the RuleEngine, starting it if the
+// RuleEngine is already running.
+func (r *RuleEngine) AddRule(rule Rule) error {
+	if err := rule.Compile(); err != nil {
+		return err
+	}
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	name := "rule:" + rule.Name
@@ -47,6 +56,7 @@ func (r *RuleEngine) AddRule(rule Rule) {
 	if r.running {
 		r.startRule(rc)
 	}
+	return nil
 }
 
 // Start starts each of the rules in a goroutine
@@ -81,7 +91,7 @@ func (r *RuleEngine) startRule(rule ruleContainer) {
 				break
 			}
 			if rule.Eval(item) {
-				r.rawMatches <- item
+				r.rawMatches <- NewMatch(&rule.Rule, item)
 			}
 		}
 		r.finished <- &rule
@@ -118,15 +128,17 @@ func (r *RuleEngine) WaitUntilFinished() {
 	<-r.allDone
 }
 
-func makeDeduplicatingChannel(input <-chan *httpsource.RequestResponsePair) <-chan *httpsource.RequestResponsePair {
-	output := make(chan *httpsource.RequestResponsePair, cap(input))
+// makeDeduplicatingChannel drops repeated matches of the same pair by the
+// same rules.  Matches of a pair by different rules are all passed on.
+func makeDeduplicatingChannel(input <-chan *Match) <-chan *Match {
+	output := make(chan *Match, cap(input))
 	go func() {
 		seen := make(map[string]bool)
-		for pair := range input {
-			fp := pair.Fingerprint()
-			if _, ok := seen[fp]; !ok {
-				seen[fp] = true
-				output <- pair
+		for m := range input {
+			key := m.Pair.Fingerprint() + "\x00" + strings.Join(m.Rules, "\x00")
+			if _, ok := seen[key]; !ok {
+				seen[key] = true
+				output <- m
 			}
 		}
 		logger.Printf("Closing dedupe output...\n")
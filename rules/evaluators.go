@@ -1,9 +1,12 @@
 package rules
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Matir/httpwatch/httpsource"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -12,17 +15,51 @@ type Evaluator interface {
 }
 
 type abstractEvaluator struct {
-	rule   *Rule
-	getter *FieldGetter
+	rule       *Rule
+	getter     *FieldGetter
+	quantifier quantifier
+	ignoreCase bool
+	value      string
+}
+
+// quantifier decides whether a rule matches given how many of a field's
+// values passed the operator's test.
+type quantifier func(matched, total int) bool
+
+func anyQuantifier(matched, _ int) bool {
+	return matched > 0
 }
 
 func BuildEvaluator(r *Rule) (Evaluator, error) {
+	if r.Expr != "" {
+		if r.Operator != "" {
+			return nil, errors.New("Rule has both an expression and an operator")
+		}
+		parsed, err := ParseExpr(r.Expr)
+		if err != nil {
+			return nil, err
+		}
+		if err := parsed.Compile(); err != nil {
+			return nil, err
+		}
+		return parsed.evaluator, nil
+	}
+
 	// Operators that don't require value
 	switch r.Operator {
 	case "&&", "and":
 		return &AndEvaluator{rule: r}, nil
 	case "||", "or":
 		return &OrEvaluator{rule: r}, nil
+	case "!", "not":
+		if len(r.Rules) != 1 {
+			return nil, fmt.Errorf("Operator not requires exactly one rule, got %d", len(r.Rules))
+		}
+		return &NotEvaluator{rule: r}, nil
+	case "script":
+		return buildScriptEvaluator(r)
+	case "sequence":
+		return buildSequenceEvaluator(r)
 	}
 
 	// These do require a value from the request/response
@@ -30,38 +67,324 @@ func BuildEvaluator(r *Rule) (Evaluator, error) {
 	if err != nil {
 		return nil, err
 	}
-	switch r.Operator {
+	q, err := buildQuantifier(r.Quantifier)
+	if err != nil {
+		return nil, err
+	}
+	base := abstractEvaluator{rule: r, getter: &getter, quantifier: q, value: r.Value}
+
+	// String operators have case-insensitive variants, e.g. contains-i
+	op := r.Operator
+	switch op {
+	case "contains-i", "startswith-i", "endswith-i", "glob-i", "in-i", "contains-any-i":
+		op = strings.TrimSuffix(op, "-i")
+		base.ignoreCase = true
+		base.value = strings.ToLower(r.Value)
+	}
+	switch op {
+	case "contains":
+		return &ContainsEvaluator{base}, nil
+	case "startswith":
+		return &StartsWithEvaluator{base}, nil
+	case "endswith":
+		return &EndsWithEvaluator{base}, nil
+	case "glob":
+		re, err := compileGlob(r.Value, base.ignoreCase)
+		if err != nil {
+			return nil, err
+		}
+		return &RegexEvaluator{base, re}, nil
+	case "in":
+		values, err := ruleValues(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, errors.New("Operator in requires a list of values")
+		}
+		set := make(map[string]bool, len(values))
+		for _, v := range values {
+			if base.ignoreCase {
+				v = strings.ToLower(v)
+			}
+			set[v] = true
+		}
+		return &InEvaluator{base, set}, nil
+	case "contains-any":
+		patterns, err := ruleValues(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(patterns) == 0 {
+			return nil, errors.New("Operator contains-any requires a list of patterns")
+		}
+		return &ContainsAnyEvaluator{base, sharedAutomaton(patterns, base.ignoreCase)}, nil
+	case "detect":
+		d, ok := detectors[r.Value]
+		if !ok {
+			return nil, fmt.Errorf("Unknown detector: %s", r.Value)
+		}
+		return &DetectorEvaluator{base, d}, nil
+	case "yara":
+		if r.Value == "" {
+			return nil, errors.New("Operator yara requires a rule file")
+		}
+		rs, err := loadYaraFile(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &YaraEvaluator{base, rs}, nil
+	case "in-cidr":
+		values, err := ruleValues(r)
+		if err != nil {
+			return nil, err
+		}
+		nets, err := parsePrefixes(values)
+		if err != nil {
+			return nil, err
+		}
+		if len(nets) == 0 {
+			return nil, errors.New("Operator in-cidr requires a list of prefixes")
+		}
+		return &CIDREvaluator{base, nets}, nil
 	case "==":
-		return &EqualsEvaluator{r, &getter}, nil
+		return &EqualsEvaluator{base}, nil
 	case "!=":
-		return &NotEqualsEvaluator{EqualsEvaluator{r, &getter}}, nil
+		return &NotEqualsEvaluator{EqualsEvaluator{base}}, nil
 	case "~=":
 		re, err := regexp.Compile(r.Value)
 		if err != nil {
 			return nil, err
 		}
-		return &RegexEvaluator{r, &getter, re}, nil
+		return &RegexEvaluator{base, re}, nil
+	case "<", "<=", ">", ">=", "in-range":
+		cmp, err := buildNumericComparison(r.Operator, r.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &NumericEvaluator{base, cmp}, nil
 	}
 	return nil, fmt.Errorf("Invalid operator: %s", r.Operator)
 }
 
+// buildNumericComparison parses the rule value as a number, or for
+// in-range an inclusive range such as 500-599.
+func buildNumericComparison(op, value string) (func(float64) bool, error) {
+	if op == "in-range" {
+		// Skip the first character so the lower bound may be negative
+		i := -1
+		if len(value) > 1 {
+			i = strings.IndexByte(value[1:], '-') + 1
+		}
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid range: %s", value)
+		}
+		lo, err := strconv.ParseFloat(strings.TrimSpace(value[:i]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid range: %s", value)
+		}
+		hi, err := strconv.ParseFloat(strings.TrimSpace(value[i+1:]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid range: %s", value)
+		}
+		return func(v float64) bool { return v >= lo && v <= hi }, nil
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid number: %s", value)
+	}
+	switch op {
+	case "<":
+		return func(v float64) bool { return v < n }, nil
+	case "<=":
+		return func(v float64) bool { return v <= n }, nil
+	case ">":
+		return func(v float64) bool { return v > n }, nil
+	}
+	return func(v float64) bool { return v >= n }, nil
+}
+
+// buildQuantifier parses any (the default), all, none, or a count
+// comparison such as count>=2.
+func buildQuantifier(q string) (quantifier, error) {
+	switch strings.ToLower(q) {
+	case "", "any":
+		return anyQuantifier, nil
+	case "all":
+		return func(matched, total int) bool { return total > 0 && matched == total }, nil
+	case "none":
+		return func(matched, _ int) bool { return matched == 0 }, nil
+	}
+	if !strings.HasPrefix(strings.ToLower(q), "count") {
+		return nil, fmt.Errorf("Invalid quantifier: %s", q)
+	}
+	expr := strings.TrimSpace(q[len("count"):])
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if !strings.HasPrefix(expr, op) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(expr[len(op):]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid quantifier: %s", q)
+		}
+		cmp := map[string]func(int) bool{
+			"==": func(m int) bool { return m == n },
+			"!=": func(m int) bool { return m != n },
+			"<=": func(m int) bool { return m <= n },
+			">=": func(m int) bool { return m >= n },
+			"<":  func(m int) bool { return m < n },
+			">":  func(m int) bool { return m > n },
+		}[op]
+		return func(matched, _ int) bool { return cmp(matched) }, nil
+	}
+	return nil, fmt.Errorf("Invalid quantifier: %s", q)
+}
+
+// compileGlob converts a shell-style pattern, where * matches any run of
+// characters (including /), ? a single character and [...] a class, to an
+// anchored regexp.
+func compileGlob(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	if ignoreCase {
+		buf.WriteString("(?i)")
+	}
+	buf.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			buf.WriteString("(?s:.*)")
+		case '?':
+			buf.WriteString("(?s:.)")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated [ in glob: %s", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// evalValues tests every value of the field and applies the quantifier.
+// Values are lowercased first for case-insensitive operators.  A field that
+// cannot be retrieved never matches.
+func evalValues(e *abstractEvaluator, pair *httpsource.RequestResponsePair, test func(string) bool) bool {
+	vals, err := (*e.getter)(pair)
+	if err != nil {
+		// TODO: log this error
+		return false
+	}
+	matched := 0
+	for _, v := range vals {
+		if e.ignoreCase {
+			v = strings.ToLower(v)
+		}
+		if test(v) {
+			matched++
+		}
+	}
+	return e.applyQuantifier(matched, len(vals))
+}
+
+func (e *abstractEvaluator) applyQuantifier(matched, total int) bool {
+	q := e.quantifier
+	if q == nil {
+		q = anyQuantifier
+	}
+	return q(matched, total)
+}
+
+// valueTester is implemented by evaluators that test each value of a field,
+// so the values that caused a match can be reported.
+type valueTester interface {
+	base() *abstractEvaluator
+	test(val string) bool
+}
+
+func (e *abstractEvaluator) base() *abstractEvaluator {
+	return e
+}
+
+// matchingValues returns the values of the field that pass the test.
+func matchingValues(e valueTester, pair *httpsource.RequestResponsePair) []string {
+	vals, err := (*e.base().getter)(pair)
+	if err != nil {
+		return nil
+	}
+	var matched []string
+	for _, v := range vals {
+		tv := v
+		if e.base().ignoreCase {
+			tv = strings.ToLower(v)
+		}
+		if e.test(tv) {
+			matched = append(matched, v)
+		}
+	}
+	return matched
+}
+
 // Possible operations
 type AndEvaluator abstractEvaluator
 type OrEvaluator abstractEvaluator
-type EqualsEvaluator abstractEvaluator
-type ContainsEvaluator abstractEvaluator
+type NotEvaluator abstractEvaluator
+type EqualsEvaluator struct {
+	abstractEvaluator
+}
+type ContainsEvaluator struct {
+	abstractEvaluator
+}
+type StartsWithEvaluator struct {
+	abstractEvaluator
+}
+type EndsWithEvaluator struct {
+	abstractEvaluator
+}
 type NotEqualsEvaluator struct {
 	EqualsEvaluator
 }
+type InEvaluator struct {
+	abstractEvaluator
+	set map[string]bool
+}
+type ContainsAnyEvaluator struct {
+	abstractEvaluator
+	ac *ahoCorasick
+}
+type YaraEvaluator struct {
+	abstractEvaluator
+	rs *yaraRuleSet
+}
+type CIDREvaluator struct {
+	abstractEvaluator
+	nets []*net.IPNet
+}
 type RegexEvaluator struct {
-	rule   *Rule
-	getter *FieldGetter
-	re     *regexp.Regexp
+	abstractEvaluator
+	re *regexp.Regexp
+}
+type NumericEvaluator struct {
+	abstractEvaluator
+	cmp func(float64) bool
 }
 
 func (e *AndEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
-	for _, r := range e.rule.Rules {
-		if !r.Eval(pair) {
+	for i := range e.rule.Rules {
+		if !e.rule.Rules[i].Eval(pair) {
 			return false
 		}
 	}
@@ -69,41 +392,211 @@ func (e *AndEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
 }
 
 func (e *OrEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
-	for _, r := range e.rule.Rules {
-		if r.Eval(pair) {
+	for i := range e.rule.Rules {
+		if e.rule.Rules[i].Eval(pair) {
 			return true
 		}
 	}
 	return false
 }
 
+func (e *NotEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return !e.rule.Rules[0].Eval(pair)
+}
+
 func (e *EqualsEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
-	val, err := (*e.getter)(pair)
-	if err != nil {
-		// TODO: log this error
-		return false
-	}
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+func (e *EqualsEvaluator) test(val string) bool {
 	return val == e.rule.Value
 }
 
 func (e *NotEqualsEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
-	return !e.EqualsEvaluator.Eval(pair)
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+func (e *NotEqualsEvaluator) test(val string) bool {
+	return val != e.rule.Value
 }
 
 func (e *ContainsEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
-	val, err := (*e.getter)(pair)
-	if err != nil {
-		// TODO: log this error
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+func (e *ContainsEvaluator) test(val string) bool {
+	return strings.Contains(val, e.value)
+}
+
+func (e *StartsWithEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+func (e *StartsWithEvaluator) test(val string) bool {
+	return strings.HasPrefix(val, e.value)
+}
+
+func (e *EndsWithEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+func (e *EndsWithEvaluator) test(val string) bool {
+	return strings.HasSuffix(val, e.value)
+}
+
+func (e *InEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+func (e *InEvaluator) test(val string) bool {
+	return e.set[val]
+}
+
+func (e *ContainsAnyEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	scan := e.scan(pair)
+	if scan.err != nil {
 		return false
 	}
-	return strings.Contains(val, e.rule.Value)
+	matched := 0
+	for _, found := range scan.found {
+		if len(found) > 0 {
+			matched++
+		}
+	}
+	return e.applyQuantifier(matched, len(scan.found))
 }
 
-func (e *RegexEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
-	val, err := (*e.getter)(pair)
-	if err != nil {
-		// TODO: log this error
+func (e *ContainsAnyEvaluator) test(val string) bool {
+	return len(e.ac.find(val)) > 0
+}
+
+// The patterns found in any value of the field
+func (e *ContainsAnyEvaluator) metadata(pair *httpsource.RequestResponsePair) map[string][]string {
+	var patterns []string
+	for _, found := range e.scan(pair).found {
+		for _, p := range found {
+			patterns = appendUnique(patterns, e.ac.patterns[p])
+		}
+	}
+	return map[string][]string{"contains-any": patterns}
+}
+
+// containsAnyScan holds the patterns found in each value of a field.
+type containsAnyScan struct {
+	found [][]int
+	err   error
+}
+
+// scan searches the values of the field once per pair, shared by every rule
+// using the same patterns on the same field.
+func (e *ContainsAnyEvaluator) scan(pair *httpsource.RequestResponsePair) *containsAnyScan {
+	key := fmt.Sprintf("contains-any.%p.%s", e.ac, e.rule.Field)
+	return pair.Memoize(key, func() interface{} {
+		vals, err := (*e.getter)(pair)
+		scan := &containsAnyScan{err: err}
+		for _, v := range vals {
+			scan.found = append(scan.found, e.ac.find(v))
+		}
+		return scan
+	}).(*containsAnyScan)
+}
+
+func (e *YaraEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	scan := e.scan(pair)
+	if scan.err != nil {
 		return false
 	}
+	matched := 0
+	for _, found := range scan.found {
+		if len(found) > 0 {
+			matched++
+		}
+	}
+	return e.applyQuantifier(matched, len(scan.found))
+}
+
+func (e *YaraEvaluator) test(val string) bool {
+	return len(e.rs.scan([]byte(val))) > 0
+}
+
+// The YARA rules, their tags and the strings found in any value of the field
+func (e *YaraEvaluator) metadata(pair *httpsource.RequestResponsePair) map[string][]string {
+	var rules, tags, strs []string
+	for _, found := range e.scan(pair).found {
+		for _, m := range found {
+			rules = appendUnique(rules, m.rule.name)
+			tags = appendUnique(tags, m.rule.tags...)
+			for _, s := range m.strings {
+				strs = appendUnique(strs, m.rule.name+":"+s)
+			}
+		}
+	}
+	md := map[string][]string{"yara.rules": rules, "yara.tags": tags, "yara.strings": strs}
+	if truncated := e.scan(pair).truncated; len(truncated) > 0 {
+		md["yara.truncated"] = truncated
+	}
+	return md
+}
+
+// yaraFieldScan holds the rules matching each value of a field, and the
+// strings whose search was stopped by the limits on a scan.
+type yaraFieldScan struct {
+	found     [][]yaraRuleMatch
+	truncated []string
+	err       error
+}
+
+// scan runs the rules over the values of the field once per pair, shared by
+// every rule using the same file on the same field.
+func (e *YaraEvaluator) scan(pair *httpsource.RequestResponsePair) *yaraFieldScan {
+	key := fmt.Sprintf("yara.%p.%s", e.rs, e.rule.Field)
+	return pair.Memoize(key, func() interface{} {
+		vals, err := (*e.getter)(pair)
+		scan := &yaraFieldScan{err: err}
+		for _, v := range vals {
+			found, truncated := e.rs.scanReport([]byte(v))
+			scan.found = append(scan.found, found)
+			scan.truncated = appendUnique(scan.truncated, truncated...)
+		}
+		if len(scan.truncated) > 0 {
+			logger.Printf("YARA scan of %s with %s stopped early for %s\n", e.rule.Field, e.rule.Value, strings.Join(scan.truncated, ", "))
+		}
+		return scan
+	}).(*yaraFieldScan)
+}
+
+func (e *CIDREvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+// Values that are not IP addresses never pass
+func (e *CIDREvaluator) test(val string) bool {
+	ip := parseIP(val)
+	if ip == nil {
+		return false
+	}
+	for _, n := range e.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *RegexEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+func (e *RegexEvaluator) test(val string) bool {
 	return e.re.MatchString(val)
 }
+
+func (e *NumericEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return evalValues(&e.abstractEvaluator, pair, e.test)
+}
+
+// Values that are not numbers never pass
+func (e *NumericEvaluator) test(val string) bool {
+	n, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	return err == nil && e.cmp(n)
+}
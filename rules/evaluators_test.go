@@ -2,7 +2,9 @@ package rules
 
 import (
 	"github.com/Matir/httpwatch/httpsource"
+	"net/http"
 	"testing"
+	"time"
 )
 
 type StubEvaluator struct {
@@ -13,8 +15,8 @@ func (e *StubEvaluator) Eval(_ *httpsource.RequestResponsePair) bool {
 	return e.val
 }
 
-func DummyGetter(_ *httpsource.RequestResponsePair) (string, error) {
-	return "Dummy value", nil
+func DummyGetter(_ *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{"Dummy value"}, nil
 }
 
 func TestAndEvaluator(t *testing.T) {
@@ -121,3 +123,191 @@ func TestRegexEvaluator(t *testing.T) {
 		t.Errorf("Expected val ~= ummy.\n")
 	}
 }
+
+func MultiGetter(_ *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{"10.0.0.1", "10.0.0.2", "192.0.2.1"}, nil
+}
+
+func TestQuantifiers(t *testing.T) {
+	tests := []struct {
+		quantifier, value string
+		expected          bool
+	}{
+		{"", `^10\.`, true},
+		{"any", `^192\.`, true},
+		{"any", `^172\.`, false},
+		{"all", `^10\.`, false},
+		{"all", `\.`, true},
+		{"none", `^172\.`, true},
+		{"none", `^10\.`, false},
+		{"count==2", `^10\.`, true},
+		{"count>=3", `^10\.`, false},
+		{"count < 1", `^172\.`, true},
+	}
+	for _, test := range tests {
+		r := Rule{
+			Operator:   "~=",
+			Field:      "request.header.x-forwarded-for",
+			Value:      test.value,
+			Quantifier: test.quantifier,
+		}
+		e, err := BuildEvaluator(&r)
+		if err != nil {
+			t.Fatalf("Unable to build evaluator: %v\n", err)
+		}
+		fg := FieldGetter(MultiGetter)
+		e.(*RegexEvaluator).getter = &fg
+		if res := e.Eval(nil); res != test.expected {
+			t.Errorf("%s ~= %s: expected %v, got %v\n", test.quantifier, test.value, test.expected, res)
+		}
+	}
+	for _, q := range []string{"some", "count", "count=>2", "count==x"} {
+		r := Rule{Operator: "==", Field: "request.url", Quantifier: q}
+		if _, err := BuildEvaluator(&r); err == nil {
+			t.Errorf("Expected error for quantifier %s\n", q)
+		}
+	}
+}
+
+func TestAllQuantifierNoValues(t *testing.T) {
+	r := Rule{Operator: "!=", Field: "request.cookie.missing", Value: "x", Quantifier: "all"}
+	e, err := BuildEvaluator(&r)
+	if err != nil {
+		t.Fatalf("Unable to build evaluator: %v\n", err)
+	}
+	req, _ := requestFromURI("http://example.com/")
+	if e.Eval(&httpsource.RequestResponsePair{Request: req}) {
+		t.Errorf("Expected all to be false with no values.\n")
+	}
+}
+
+func TestAbsentHeader(t *testing.T) {
+	req, _ := requestFromURI("http://example.com/")
+	pair := &httpsource.RequestResponsePair{Request: req}
+	tests := []struct {
+		rule     Rule
+		expected bool
+	}{
+		{Rule{Operator: "==", Field: "request.header.referer", Value: ""}, true},
+		{Rule{Operator: "!=", Field: "request.header.x-api-key", Value: "secret"}, true},
+		{Rule{Operator: "==", Field: "request.header.x-api-key", Value: "secret"}, false},
+		{Rule{Operator: "==", Field: "request.header.x-forwarded-for", Value: ""}, true},
+	}
+	for _, test := range tests {
+		e, err := BuildEvaluator(&test.rule)
+		if err != nil {
+			t.Fatalf("Unable to build evaluator: %v\n", err)
+		}
+		if res := e.Eval(pair); res != test.expected {
+			t.Errorf("%s %s %q: expected %v, got %v\n", test.rule.Field, test.rule.Operator, test.rule.Value, test.expected, res)
+		}
+	}
+}
+
+func TestNumericEvaluator(t *testing.T) {
+	resp := &http.Response{StatusCode: 503, ContentLength: 20 << 20, Header: make(http.Header)}
+	pair := &httpsource.RequestResponsePair{Response: resp, ResponseBody: []byte("down")}
+	tests := []struct {
+		field, operator, value string
+		expected               bool
+	}{
+		{"response.code", "==", "503", true},
+		{"response.code", "in-range", "500-599", true},
+		{"response.code", "in-range", "200-299", false},
+		{"response.code", ">=", "500", true},
+		{"response.code", "<", "500", false},
+		{"response.contentlength", ">", "10485760", true},
+		{"response.bodysize", "<=", "4", true},
+		{"response.headercount", "==", "0", true},
+		{"response.status", ">", "0", false},
+	}
+	for _, test := range tests {
+		r := Rule{Operator: test.operator, Field: test.field, Value: test.value}
+		e, err := BuildEvaluator(&r)
+		if err != nil {
+			t.Fatalf("Unable to build evaluator: %v\n", err)
+		}
+		if res := e.Eval(pair); res != test.expected {
+			t.Errorf("%s %s %s: expected %v, got %v\n", test.field, test.operator, test.value, test.expected, res)
+		}
+	}
+	for _, bad := range []struct{ operator, value string }{{"<", "x"}, {"in-range", "5"}, {"in-range", "1-x"}, {"in-range", ""}} {
+		r := Rule{Operator: bad.operator, Field: "response.code", Value: bad.value}
+		if _, err := BuildEvaluator(&r); err == nil {
+			t.Errorf("Expected error for %s %s\n", bad.operator, bad.value)
+		}
+	}
+}
+
+func TestLatencyGetter(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	pair := &httpsource.RequestResponsePair{RequestTime: t0, ResponseTime: t0.Add(1500 * time.Microsecond)}
+	if vals, err := responseLatencyGetter(pair); err != nil || !equalValues(vals, []string{"1.5"}) {
+		t.Errorf("Expected 1.5ms, got %v (%v)\n", vals, err)
+	}
+	if _, err := responseLatencyGetter(&httpsource.RequestResponsePair{}); err == nil {
+		t.Errorf("Expected an error without timestamps.\n")
+	}
+}
+
+func TestStringEvaluators(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/Admin/Login.php?next=/", nil)
+	req.Header.Set("User-Agent", "sqlmap/1.7")
+	pair := &httpsource.RequestResponsePair{Request: req}
+	tests := []struct {
+		field, operator, value string
+		values                 []string
+		expected               bool
+	}{
+		{"request.url", "contains", "Login", nil, true},
+		{"request.url", "contains", "login", nil, false},
+		{"request.url", "contains-i", "LOGIN", nil, true},
+		{"request.header.user-agent", "startswith", "sqlmap/", nil, true},
+		{"request.header.user-agent", "startswith", "SQLMAP", nil, false},
+		{"request.header.user-agent", "startswith-i", "SQLMAP", nil, true},
+		{"request.url", "endswith", "?next=/", nil, true},
+		{"request.url", "endswith-i", "LOGIN.PHP", nil, false},
+		{"request.url", "glob", "http://*/Admin/*.php?*", nil, true},
+		{"request.url", "glob", "http://*/admin/*", nil, false},
+		{"request.url", "glob-i", "http://*/admin/*", nil, true},
+		{"request.url", "glob", "http://example.co?/*", nil, true},
+		{"request.url", "glob", "http://example.co[!m]/*", nil, false},
+		{"request.method", "in", "", []string{"POST", "GET"}, true},
+		{"request.method", "in", "", []string{"post", "put"}, false},
+		{"request.method", "in-i", "", []string{"post", "get"}, true},
+	}
+	for _, test := range tests {
+		r := Rule{Operator: test.operator, Field: test.field, Value: test.value, Values: test.values}
+		e, err := BuildEvaluator(&r)
+		if err != nil {
+			t.Fatalf("Unable to build evaluator: %v\n", err)
+		}
+		if res := e.Eval(pair); res != test.expected {
+			t.Errorf("%s %s %s%v: expected %v, got %v\n", test.field, test.operator, test.value, test.values, test.expected, res)
+		}
+	}
+	for _, bad := range []Rule{
+		{Operator: "in", Field: "request.method"},
+		{Operator: "glob", Field: "request.url", Value: "[abc"},
+		{Operator: "==-i", Field: "request.url"},
+	} {
+		if _, err := BuildEvaluator(&bad); err == nil {
+			t.Errorf("Expected error for %s %q\n", bad.Operator, bad.Value)
+		}
+	}
+}
+
+func TestNotEvaluator(t *testing.T) {
+	r := Rule{Operator: "not", Rules: []Rule{{evaluator: &StubEvaluator{false}}}}
+	e, err := BuildEvaluator(&r)
+	if err != nil {
+		t.Fatalf("Unable to build evaluator: %v\n", err)
+	}
+	if !e.Eval(nil) {
+		t.Errorf("not fRule == false!?")
+	}
+	r = Rule{Operator: "not", Rules: []Rule{{}, {}}}
+	if _, err := BuildEvaluator(&r); err == nil {
+		t.Errorf("Expected error for not with two rules.\n")
+	}
+}
@@ -0,0 +1,407 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are an alternative to nested Rule trees, for example:
+//
+//   request.method == "POST" and request.url.path ~= '^/admin'
+//     and not response.code in [401, 403]
+//
+// Comparisons are written as [quantifier] field operator value, where the
+// quantifier is any, all, none or a count such as count>=2, and a value is a
+// number, a bare word such as @name, a double-quoted string with Go escapes,
+// a single-quoted string taken literally, or a [list] of these.  Fields that
+// contain spaces or operator characters, such as CSS selectors, may be quoted
+// with backticks.  not binds tighter than and, which binds tighter than or;
+// && , || and ! are accepted as well.
+
+// ExprError is a syntax or compilation error at a position in an expression.
+type ExprError struct {
+	Expr string
+	Pos  int
+	Msg  string
+}
+
+func (e *ExprError) Error() string {
+	line, col := 1, 1
+	for _, c := range e.Expr[:e.Pos] {
+		if c == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf("Error in expression at %d:%d: %s", line, col, e.Msg)
+}
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokWord
+	tokField
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+// Operators written as words, in addition to the symbolic ones
+var wordOperators = map[string]bool{
+	"contains": true, "contains-i": true,
+	"startswith": true, "startswith-i": true,
+	"endswith": true, "endswith-i": true,
+	"glob": true, "glob-i": true,
+	"in": true, "in-i": true,
+	"in-range": true, "in-cidr": true,
+	"contains-any": true, "contains-any-i": true,
+	"yara": true, "detect": true,
+}
+
+var comparisonOperators = map[string]bool{
+	"==": true, "!=": true, "~=": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+// ParseExpr compiles an expression to a Rule.  Comparisons are built as they
+// are parsed, so unknown fields and invalid values are reported with their
+// position too.
+func ParseExpr(expr string) (*Rule, error) {
+	toks, err := lexExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{expr: expr, toks: toks}
+	r, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok.pos, "unexpected %s", describeToken(tok))
+	}
+	return r, nil
+}
+
+func isWordChar(c byte) bool {
+	return !unicode.IsSpace(rune(c)) && !strings.ContainsRune("()[],\"'`=!<>~&|", rune(c))
+}
+
+func lexExpr(expr string) ([]exprToken, error) {
+	var toks []exprToken
+	errorf := func(pos int, format string, args ...interface{}) error {
+		return &ExprError{Expr: expr, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		start := i
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"':
+			end, ok := scanQuoted(expr, i)
+			if !ok {
+				return nil, errorf(start, "unterminated string")
+			}
+			s, err := strconv.Unquote(expr[i:end])
+			if err != nil {
+				return nil, errorf(start, "invalid string: %v", err)
+			}
+			toks = append(toks, exprToken{tokString, s, start})
+			i = end
+		case c == '\'' || c == '`':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end == -1 {
+				return nil, errorf(start, "unterminated %c", c)
+			}
+			kind := tokString
+			if c == '`' {
+				kind = tokField
+			}
+			toks = append(toks, exprToken{kind, expr[i+1 : i+1+end], start})
+			i += end + 2
+		case c == '(':
+			toks = append(toks, exprToken{tokLParen, "(", start})
+			i++
+		case c == ')':
+			toks = append(toks, exprToken{tokRParen, ")", start})
+			i++
+		case c == '[':
+			toks = append(toks, exprToken{tokLBracket, "[", start})
+			i++
+		case c == ']':
+			toks = append(toks, exprToken{tokRBracket, "]", start})
+			i++
+		case c == ',':
+			toks = append(toks, exprToken{tokComma, ",", start})
+			i++
+		case strings.ContainsRune("=!<>~&|", rune(c)):
+			op := expr[i : i+1]
+			if i+1 < len(expr) {
+				switch two := expr[i : i+2]; two {
+				case "==", "!=", "~=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			switch op {
+			case "=", "~", "&", "|":
+				return nil, errorf(start, "unknown operator %q", op)
+			}
+			toks = append(toks, exprToken{tokOp, op, start})
+			i += len(op)
+		default:
+			end, err := scanWord(expr, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, exprToken{tokWord, expr[i:end], start})
+			i = end
+		}
+	}
+	return append(toks, exprToken{tokEOF, "", len(expr)}), nil
+}
+
+// scanQuoted returns the end of the double-quoted string starting at i.
+func scanQuoted(expr string, i int) (int, bool) {
+	for j := i + 1; j < len(expr); j++ {
+		switch expr[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1, true
+		}
+	}
+	return 0, false
+}
+
+// scanWord returns the end of the word starting at i.  Field paths may
+// contain bracketed or parenthesized groups, such as JSONPath indexes or
+// ::attr(name), which are kept as part of the word.
+func scanWord(expr string, i int) (int, error) {
+	start := i
+	for i < len(expr) {
+		c := expr[i]
+		if isWordChar(c) {
+			i++
+			continue
+		}
+		// Transforms, as in request.url.query|urldecode
+		if c == '|' && i+1 < len(expr) && expr[i+1] >= 'a' && expr[i+1] <= 'z' && strings.ContainsRune(expr[start:i], '.') {
+			i++
+			continue
+		}
+		if (c != '[' && c != '(') || !strings.ContainsRune(expr[start:i], '.') {
+			break
+		}
+		depth := 0
+		for ; i < len(expr); i++ {
+			switch expr[i] {
+			case '[', '(':
+				depth++
+			case ']', ')':
+				depth--
+			case '"', '\'':
+				end := strings.IndexByte(expr[i+1:], expr[i])
+				if end == -1 {
+					return 0, &ExprError{Expr: expr, Pos: i, Msg: "unterminated string"}
+				}
+				i += end + 1
+			}
+			if depth == 0 {
+				i++
+				break
+			}
+		}
+		if depth != 0 {
+			return 0, &ExprError{Expr: expr, Pos: start, Msg: "unbalanced brackets in field"}
+		}
+	}
+	return i, nil
+}
+
+func describeToken(tok exprToken) string {
+	switch tok.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(tok.text)
+	}
+	return "'" + tok.text + "'"
+}
+
+type exprParser struct {
+	expr string
+	toks []exprToken
+	i    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.toks[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *exprParser) errorf(pos int, format string, args ...interface{}) error {
+	return &ExprError{Expr: p.expr, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// isKeyword returns true if tok is one of the keywords, or symbols, given.
+func isKeyword(tok exprToken, words ...string) bool {
+	if tok.kind != tokWord && tok.kind != tokOp {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(tok.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a chain of operands joined by one of the operator keywords.
+func (p *exprParser) parseChain(op string, keywords []string, operand func() (*Rule, error)) (*Rule, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	rules := []Rule{*first}
+	for isKeyword(p.peek(), keywords...) {
+		p.next()
+		r, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *r)
+	}
+	if len(rules) == 1 {
+		return first, nil
+	}
+	return &Rule{Operator: op, Rules: rules}, nil
+}
+
+func (p *exprParser) parseOr() (*Rule, error) {
+	return p.parseChain("or", []string{"or", "||"}, p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (*Rule, error) {
+	return p.parseChain("and", []string{"and", "&&"}, p.parseUnary)
+}
+
+func (p *exprParser) parseUnary() (*Rule, error) {
+	if isKeyword(p.peek(), "not", "!") {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Rule{Operator: "not", Rules: []Rule{*r}}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		r, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokRParen {
+			return nil, p.errorf(tok.pos, "expected ')', got %s", describeToken(tok))
+		}
+		return r, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (*Rule, error) {
+	r := &Rule{}
+	tok := p.peek()
+	if tok.kind == tokWord && !strings.ContainsRune(tok.text, '.') {
+		switch {
+		case isKeyword(tok, "any", "all", "none"):
+			p.next()
+			r.Quantifier = strings.ToLower(tok.text)
+		case isKeyword(tok, "count"):
+			p.next()
+			op, n := p.next(), p.next()
+			if op.kind != tokOp || !comparisonOperators[op.text] || op.text == "~=" || n.kind != tokWord {
+				return nil, p.errorf(tok.pos, "expected a count such as count>=2")
+			}
+			r.Quantifier = "count" + op.text + n.text
+		}
+	}
+
+	field := p.next()
+	if field.kind != tokField && (field.kind != tokWord || !strings.ContainsRune(field.text, '.')) {
+		return nil, p.errorf(field.pos, "expected a field, got %s", describeToken(field))
+	}
+	r.Field = field.text
+
+	op := p.next()
+	switch {
+	case op.kind == tokOp && comparisonOperators[op.text]:
+	case op.kind == tokWord && wordOperators[strings.ToLower(op.text)]:
+	default:
+		return nil, p.errorf(op.pos, "expected an operator after %s, got %s", r.Field, describeToken(op))
+	}
+	r.Operator = strings.ToLower(op.text)
+
+	value := p.peek()
+	if value.kind == tokLBracket {
+		p.next()
+		r.Values = []string{}
+		for p.peek().kind != tokRBracket {
+			if len(r.Values) > 0 {
+				if tok := p.next(); tok.kind != tokComma {
+					return nil, p.errorf(tok.pos, "expected ',' or ']' in list, got %s", describeToken(tok))
+				}
+			}
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			r.Values = append(r.Values, v)
+		}
+		p.next()
+	} else {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		r.Value = v
+	}
+
+	e, err := BuildEvaluator(r)
+	if err != nil {
+		pos := value.pos
+		if _, ferr := buildGetter(r.Field); ferr != nil {
+			pos = field.pos
+		}
+		return nil, p.errorf(pos, "%v", err)
+	}
+	r.evaluator = e
+	return r, nil
+}
+
+func (p *exprParser) parseValue() (string, error) {
+	tok := p.next()
+	if tok.kind != tokString && tok.kind != tokWord {
+		return "", p.errorf(tok.pos, "expected a value, got %s", describeToken(tok))
+	}
+	return tok.text, nil
+}
@@ -0,0 +1,93 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseExprTree(t *testing.T) {
+	r, err := ParseExpr(`request.method == "POST" and request.url.path ~= '^/admin' and not response.code in [401,403]`)
+	if err != nil {
+		t.Fatalf("Unable to parse: %v\n", err)
+	}
+	if r.Operator != "and" || len(r.Rules) != 3 {
+		t.Fatalf("Expected and of 3 rules, got %s of %d\n", r.Operator, len(r.Rules))
+	}
+	if m := r.Rules[0]; m.Field != "request.method" || m.Operator != "==" || m.Value != "POST" {
+		t.Errorf("Unexpected first rule: %+v\n", m)
+	}
+	if p := r.Rules[1]; p.Operator != "~=" || p.Value != "^/admin" {
+		t.Errorf("Unexpected second rule: %+v\n", p)
+	}
+	not := r.Rules[2]
+	if not.Operator != "not" || len(not.Rules) != 1 {
+		t.Fatalf("Unexpected third rule: %+v\n", not)
+	}
+	if in := not.Rules[0]; in.Operator != "in" || !equalValues(in.Values, []string{"401", "403"}) {
+		t.Errorf("Unexpected negated rule: %+v\n", in)
+	}
+}
+
+func TestParseExprEval(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/admin/users", nil)
+	req.Header.Add("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	pair := &httpsource.RequestResponsePair{Request: req, Response: &http.Response{StatusCode: 200}}
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`request.method == "POST" and request.url.path ~= '^/admin' and not response.code in [401,403]`, true},
+		{`request.method == "GET" or response.code in-range 200-299`, true},
+		{`request.method == "GET" or response.code == 200 and request.url.path contains "nope"`, false},
+		{`(request.method == "GET" or response.code == 200) and request.url.path contains "users"`, true},
+		{`!(request.method != "POST") && response.code >= 200`, true},
+		{`not not request.method startswith-i "po"`, true},
+		{`all request.header.x-forwarded-for in-cidr "10.0.0.0/8"`, true},
+		{`count>=2 request.header.x-forwarded-for startswith "10."`, true},
+		{`count == 1 request.header.x-forwarded-for startswith "10."`, false},
+		{"`request.url.path` glob \"/admin/*\"", true},
+		{"request.url.path ==\n  \"/admin/users\"", true},
+		{`request.url.path|upper startswith "/ADMIN" and request.method|length == 4`, true},
+		{`request.method|lower == "get"||request.method|lower == "post"`, true},
+	}
+	for _, test := range tests {
+		r := Rule{Expr: test.expr}
+		if res := r.Eval(pair); res != test.expected {
+			t.Errorf("%s: expected %v, got %v\n", test.expr, test.expected, res)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		expr, position, msg string
+	}{
+		{`request.method ==`, "1:18", "expected a value"},
+		{`request.method = "GET"`, "1:16", "unknown operator"},
+		{`request.method "GET"`, "1:16", "expected an operator"},
+		{`"GET" == request.method`, "1:1", "expected a field"},
+		{`request.methd == "GET"`, "1:1", "Unknown field"},
+		{`request.url ~= "("`, "1:16", "missing closing )"},
+		{`(request.method == "GET"`, "1:25", "expected ')'"},
+		{`request.method == "GET" response.code == 200`, "1:25", "unexpected"},
+		{`request.method == "GET`, "1:19", "unterminated string"},
+		{`response.code in [401 403]`, "1:23", "expected ',' or ']'"},
+		{"request.method == \"GET\" and\n  request.url ~= '['", "2:18", "missing closing ]"},
+		{`count request.method == "GET"`, "1:1", "expected a count"},
+	}
+	for _, test := range tests {
+		_, err := ParseExpr(test.expr)
+		if err == nil {
+			t.Errorf("%s: expected an error\n", test.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), " "+test.position+": ") || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%s: expected %q at %s, got %v\n", test.expr, test.msg, test.position, err)
+		}
+	}
+	if _, err := BuildEvaluator(&Rule{Expr: `request.method == "GET"`, Operator: "=="}); err == nil {
+		t.Errorf("Expected an error with both expr and operator.\n")
+	}
+}
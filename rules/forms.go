@@ -0,0 +1,126 @@
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// requestForm is the parsed body of a urlencoded or multipart request.
+type requestForm struct {
+	values url.Values
+	parts  map[string][]*formPart
+}
+
+// formPart is a single part of a multipart body.
+type formPart struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// getRequestForm parses the request body once per pair.
+func getRequestForm(pair *httpsource.RequestResponsePair) *requestForm {
+	return pair.Memoize("form", func() interface{} {
+		return parseRequestForm(pair)
+	}).(*requestForm)
+}
+
+func parseRequestForm(pair *httpsource.RequestResponsePair) *requestForm {
+	form := &requestForm{values: make(url.Values), parts: make(map[string][]*formPart)}
+	if pair.Request == nil {
+		return form
+	}
+	mt, params, err := mime.ParseMediaType(pair.Request.Header.Get("Content-Type"))
+	if err != nil {
+		return form
+	}
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		// Keep whatever parsed before any error
+		values, err := url.ParseQuery(string(pair.RequestBody))
+		if err != nil {
+			logger.Printf("Error parsing form: %v\n", err)
+		}
+		form.values = values
+	case strings.HasPrefix(mt, "multipart/"):
+		r := multipart.NewReader(bytes.NewReader(pair.RequestBody), params["boundary"])
+		for {
+			p, err := r.NextPart()
+			if err != nil {
+				break
+			}
+			content, err := ioutil.ReadAll(p)
+			if err != nil {
+				logger.Printf("Error reading multipart body: %v\n", err)
+				break
+			}
+			name := p.FormName()
+			form.parts[name] = append(form.parts[name], &formPart{
+				Filename:    p.FileName(),
+				ContentType: p.Header.Get("Content-Type"),
+				Content:     content,
+			})
+			if p.FileName() == "" {
+				form.values.Add(name, string(content))
+			}
+		}
+	}
+	return form
+}
+
+// Get the values of a query parameter from the URL
+func buildQueryParamGetter(name string) (FieldGetter, error) {
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		u := pair.Request.URL
+		if u == nil {
+			return nil, errors.New("No URL in Request")
+		}
+		return u.Query()[name], nil
+	}, nil
+}
+
+// Get the values of a form field from a urlencoded or multipart body
+func buildFormValueGetter(name string) (FieldGetter, error) {
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		return getRequestForm(pair).values[name], nil
+	}, nil
+}
+
+// Get the parts of a multipart body, either as <field> for the content or
+// <field>.<attribute> for one of filename, contenttype or content.
+func buildMultipartGetter(attribute string) (FieldGetter, error) {
+	name, sub := attribute, "content"
+	if i := strings.LastIndexByte(attribute, '.'); i != -1 {
+		switch attribute[i+1:] {
+		case "filename", "contenttype", "content":
+			name, sub = attribute[:i], attribute[i+1:]
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("No multipart field in %s", attribute)
+	}
+	var getter func(p *formPart) string
+	switch sub {
+	case "filename":
+		getter = func(p *formPart) string { return p.Filename }
+	case "contenttype":
+		getter = func(p *formPart) string { return p.ContentType }
+	case "content":
+		getter = func(p *formPart) string { return string(p.Content) }
+	}
+
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		var vals []string
+		for _, p := range getRequestForm(pair).parts[name] {
+			vals = append(vals, getter(p))
+		}
+		return vals, nil
+	}, nil
+}
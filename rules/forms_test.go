@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"bytes"
+	"github.com/Matir/httpwatch/httpsource"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type getterTest struct {
+	field  string
+	values []string
+}
+
+func checkGetters(t *testing.T, pair *httpsource.RequestResponsePair, tests []getterTest) {
+	for _, test := range tests {
+		g, err := buildGetter(test.field)
+		if err != nil {
+			t.Fatalf("Error building %s: %v\n", test.field, err)
+		}
+		if vals, err := g(pair); err != nil || !equalValues(vals, test.values) {
+			t.Errorf("%s: expected %q, got %q (%v)\n", test.field, test.values, vals, err)
+		}
+	}
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueryParamGetter(t *testing.T) {
+	req, _ := requestFromURI("http://example.com/search?q=a%20b&id=1&id=2")
+	pair := &httpsource.RequestResponsePair{Request: req}
+	checkGetters(t, pair, []getterTest{
+		{"request.query.q", []string{"a b"}},
+		{"request.query.id", []string{"1", "2"}},
+		{"request.query.missing", nil},
+	})
+}
+
+func TestURLEncodedFormGetter(t *testing.T) {
+	body := "user=admin&password=hunter2"
+	req, _ := http.NewRequest("POST", "http://example.com/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	pair := &httpsource.RequestResponsePair{Request: req, RequestBody: []byte(body)}
+	checkGetters(t, pair, []getterTest{
+		{"request.form.user", []string{"admin"}},
+		{"request.form.password", []string{"hunter2"}},
+		{"request.form.missing", nil},
+	})
+}
+
+func TestMultipartGetters(t *testing.T) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("title", "report")
+	fw, _ := w.CreateFormFile("upload.file", "shell.php")
+	fw.Write([]byte("<?php system($_GET['c']); ?>"))
+	w.Close()
+	req, _ := http.NewRequest("POST", "http://example.com/upload", nil)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	pair := &httpsource.RequestResponsePair{Request: req, RequestBody: body.Bytes()}
+	checkGetters(t, pair, []getterTest{
+		{"request.form.title", []string{"report"}},
+		{"request.form.upload.file", nil},
+		{"request.multipart.title", []string{"report"}},
+		{"request.multipart.upload.file.filename", []string{"shell.php"}},
+		{"request.multipart.upload.file.contenttype", []string{"application/octet-stream"}},
+		{"request.multipart.upload.file", []string{"<?php system($_GET['c']); ?>"}},
+		{"request.multipart.missing.filename", nil},
+	})
+}
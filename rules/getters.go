@@ -7,21 +7,45 @@ import (
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type FieldGetter func(*httpsource.RequestResponsePair) (string, error)
+// FieldGetter returns every value of a field in a pair.  Fields such as
+// headers may have several values, and others such as cookies have none if
+// they are absent.
+type FieldGetter func(*httpsource.RequestResponsePair) ([]string, error)
 
-// Possible getters
+// Possible getters, with any transforms (see transforms.go)
 func buildGetter(value string) (FieldGetter, error) {
 	if value == "" {
 		return nil, errors.New("No field specified.")
 	}
+	field, steps, err := splitTransforms(value)
+	if err != nil {
+		return nil, err
+	}
+	getter, err := buildFieldGetter(field)
+	if err != nil || len(steps) == 0 {
+		return getter, err
+	}
+	return buildTransformGetter(getter, steps), nil
+}
+
+func buildFieldGetter(value string) (FieldGetter, error) {
 	rr, remains, err := splitFirst(value, ".")
 	if err != nil {
 		return nil, err
 	}
 	rr = strings.ToLower(rr)
+	switch rr {
+	case "grpc":
+		return buildGRPCGetter(remains)
+	case "client", "server":
+		return buildAddrGetter(rr, remains)
+	}
 	if rr != "request" && rr != "response" {
 		return nil, fmt.Errorf("Unknown entity: %s", rr)
 	}
@@ -36,12 +60,35 @@ func buildTwoPartGetter(rr, field, attribute string) (FieldGetter, error) {
 	switch field {
 	case "header":
 		return buildHeaderValueGetter(rr, attribute)
+	case "json":
+		return buildJSONPathGetter(rr, attribute)
+	case "html":
+		return buildHTMLGetter(rr, attribute)
+	case "xml":
+		return buildXPathGetter(rr, attribute)
+	case "jwt":
+		return buildJWTGetter(rr, attribute)
 	}
 	switch rr {
 	case "request":
 		switch field {
 		case "url":
 			return buildURLFieldGetter(attribute)
+		case "query":
+			return buildQueryParamGetter(attribute)
+		case "form":
+			return buildFormValueGetter(attribute)
+		case "multipart":
+			return buildMultipartGetter(attribute)
+		case "cookie":
+			return buildCookieGetter(attribute)
+		}
+	case "response":
+		switch field {
+		case "event":
+			return buildEventFieldGetter(attribute)
+		case "setcookie":
+			return buildSetCookieGetter(attribute)
 		}
 	}
 	return nil, fmt.Errorf("Unknown field: %s", field)
@@ -59,6 +106,10 @@ func buildOnePartGetter(rr, field string) (FieldGetter, error) {
 			return requestMethodGetter, nil
 		case "host":
 			return requestHostGetter, nil
+		case "contentlength":
+			return requestContentLengthGetter, nil
+		case "bodysize":
+			return requestBodySizeGetter, nil
 		}
 	case "response":
 		switch field {
@@ -68,8 +119,20 @@ func buildOnePartGetter(rr, field string) (FieldGetter, error) {
 			return responseCodeGetter, nil
 		case "status":
 			return responseStatusGetter, nil
+		case "contentlength":
+			return responseContentLengthGetter, nil
+		case "bodysize":
+			return responseBodySizeGetter, nil
+		case "latency":
+			return responseLatencyGetter, nil
 		}
 	}
+	switch field {
+	case "headercount":
+		return buildHeaderCountGetter(rr), nil
+	case "headers":
+		return buildHeadersGetter(rr), nil
+	}
 	return nil, fmt.Errorf("Unknown field: %s", field)
 }
 
@@ -82,6 +145,38 @@ func responseHeaderGetter(pair *httpsource.RequestResponsePair) http.Header {
 	return pair.Response.Header
 }
 
+// Headers whose values are comma-separated lists.  Other headers, including
+// unknown ones, may contain commas within a value, such as in dates.
+var listHeaders = map[string]bool{
+	"Accept":                         true,
+	"Accept-Charset":                 true,
+	"Accept-Encoding":                true,
+	"Accept-Language":                true,
+	"Accept-Ranges":                  true,
+	"Access-Control-Allow-Headers":   true,
+	"Access-Control-Allow-Methods":   true,
+	"Access-Control-Expose-Headers":  true,
+	"Access-Control-Request-Headers": true,
+	"Allow":                          true,
+	"Cache-Control":                  true,
+	"Connection":                     true,
+	"Content-Encoding":               true,
+	"Content-Language":               true,
+	"Forwarded":                      true,
+	"If-Match":                       true,
+	"If-None-Match":                  true,
+	"Pragma":                         true,
+	"Te":                             true,
+	"Trailer":                        true,
+	"Transfer-Encoding":              true,
+	"Upgrade":                        true,
+	"Vary":                           true,
+	"Via":                            true,
+	"X-Forwarded-For":                true,
+}
+
+// Each header line is a value, and lists such as X-Forwarded-For are split
+// into their elements.  An absent header has a single empty value.
 func buildHeaderValueGetter(rr, name string) (FieldGetter, error) {
 	getter := requestHeaderGetter
 	if rr == "response" {
@@ -89,23 +184,35 @@ func buildHeaderValueGetter(rr, name string) (FieldGetter, error) {
 	}
 	// Canonicalize header name
 	name = textproto.CanonicalMIMEHeaderKey(name)
-	return func(pair *httpsource.RequestResponsePair) (string, error) {
-		h := getter(pair)
-		if val, ok := h[name]; ok {
-			return strings.Join(val, ";"), nil
+	split := listHeaders[name]
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		lines, ok := getter(pair)[name]
+		if !ok {
+			return []string{""}, nil
 		}
-		return "", nil
+		if !split {
+			return lines, nil
+		}
+		var vals []string
+		for _, line := range lines {
+			for _, v := range strings.Split(line, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					vals = append(vals, v)
+				}
+			}
+		}
+		return vals, nil
 	}, nil
 }
 
 // Build URL matching code
 func buildURLGetter() FieldGetter {
-	return func(pair *httpsource.RequestResponsePair) (string, error) {
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
 		u := pair.Request.URL
 		if u == nil {
-			return "", errors.New("No URL in Request.")
+			return nil, errors.New("No URL in Request.")
 		}
-		return u.String(), nil
+		return []string{u.String()}, nil
 	}
 }
 
@@ -127,38 +234,148 @@ func buildURLFieldGetter(field string) (FieldGetter, error) {
 		return nil, fmt.Errorf("Unknown field: %s", field)
 	}
 
-	return func(pair *httpsource.RequestResponsePair) (string, error) {
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
 		u := pair.Request.URL
 		if u == nil {
-			return "", errors.New("No URL in Request")
+			return nil, errors.New("No URL in Request")
 		}
-		return getter(u), nil
+		return []string{getter(u)}, nil
+	}, nil
+}
+
+// Get a single element from a server-sent event sub-record
+func buildEventFieldGetter(field string) (FieldGetter, error) {
+	var getter func(ev *httpsource.ServerSentEvent) string
+	switch field {
+	case "id":
+		getter = func(ev *httpsource.ServerSentEvent) string { return ev.ID }
+	case "event", "type":
+		getter = func(ev *httpsource.ServerSentEvent) string { return ev.Event }
+	case "data":
+		getter = func(ev *httpsource.ServerSentEvent) string { return ev.Data }
+	case "retry":
+		getter = func(ev *httpsource.ServerSentEvent) string { return strconv.Itoa(ev.Retry) }
+	default:
+		return nil, fmt.Errorf("Unknown field: %s", field)
+	}
+
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		ev := pair.Event
+		if ev == nil {
+			return nil, errors.New("No event in pair")
+		}
+		return []string{getter(ev)}, nil
 	}, nil
 }
 
 // Literal getters
-func requestBodyGetter(pair *httpsource.RequestResponsePair) (string, error) {
-	return string(pair.RequestBody), nil
+// gRPC bodies are returned as JSON, one value per message, when a descriptor
+// for the method is loaded.
+func requestBodyGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	if call := getGRPCCall(pair); call != nil && call.RequestJSON != nil {
+		return call.RequestJSON, nil
+	}
+	return []string{string(pair.RequestBody)}, nil
+}
+
+func responseBodyGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	if call := getGRPCCall(pair); call != nil && call.ResponseJSON != nil {
+		return call.ResponseJSON, nil
+	}
+	return []string{string(pair.ResponseBody)}, nil
 }
 
-func responseBodyGetter(pair *httpsource.RequestResponsePair) (string, error) {
-	return string(pair.ResponseBody), nil
+func requestMethodGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{pair.Request.Method}, nil
 }
 
-func requestMethodGetter(pair *httpsource.RequestResponsePair) (string, error) {
-	return pair.Request.Method, nil
+func requestHostGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{pair.Request.Host}, nil
 }
 
-func requestHostGetter(pair *httpsource.RequestResponsePair) (string, error) {
-	return pair.Request.Host, nil
+func responseCodeGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{strconv.Itoa(pair.Response.StatusCode)}, nil
 }
 
-func responseCodeGetter(pair *httpsource.RequestResponsePair) (string, error) {
-	return string(pair.Response.StatusCode), nil
+func responseStatusGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{pair.Response.Status}, nil
 }
 
-func responseStatusGetter(pair *httpsource.RequestResponsePair) (string, error) {
-	return pair.Response.Status, nil
+// Numeric getters
+// Content length is the declared length, with no value if it was unknown.
+func contentLengthValues(length int64) []string {
+	if length < 0 {
+		return nil
+	}
+	return []string{strconv.FormatInt(length, 10)}
+}
+
+func requestContentLengthGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return contentLengthValues(pair.Request.ContentLength), nil
+}
+
+func responseContentLengthGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return contentLengthValues(pair.Response.ContentLength), nil
+}
+
+func requestBodySizeGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{strconv.Itoa(len(pair.RequestBody))}, nil
+}
+
+func responseBodySizeGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	return []string{strconv.Itoa(len(pair.ResponseBody))}, nil
+}
+
+// Number of header lines, counting repeated headers individually
+func buildHeaderCountGetter(rr string) FieldGetter {
+	getter := requestHeaderGetter
+	if rr == "response" {
+		getter = responseHeaderGetter
+	}
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		count := 0
+		for _, vals := range getter(pair) {
+			count += len(vals)
+		}
+		return []string{strconv.Itoa(count)}, nil
+	}
+}
+
+// All of the headers as a single value of "Name: value" lines, sorted by
+// name, for matching the header block as a whole.
+func buildHeadersGetter(rr string) FieldGetter {
+	getter := requestHeaderGetter
+	if rr == "response" {
+		getter = responseHeaderGetter
+	}
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		if rr == "response" && pair.Response == nil {
+			return nil, nil
+		}
+		h := getter(pair)
+		names := make([]string, 0, len(h))
+		for name := range h {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var buf strings.Builder
+		for _, name := range names {
+			for _, v := range h[name] {
+				buf.WriteString(name + ": " + v + "\r\n")
+			}
+		}
+		return []string{buf.String()}, nil
+	}
+}
+
+// Latency in milliseconds between the start of the request and the start of
+// the response, if they were captured.
+func responseLatencyGetter(pair *httpsource.RequestResponsePair) ([]string, error) {
+	if pair.RequestTime.IsZero() || pair.ResponseTime.IsZero() {
+		return nil, errors.New("No timestamps in pair")
+	}
+	ms := float64(pair.ResponseTime.Sub(pair.RequestTime)) / float64(time.Millisecond)
+	return []string{strconv.FormatFloat(ms, 'f', -1, 64)}, nil
 }
 
 // Utility functions
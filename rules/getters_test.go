@@ -19,7 +19,7 @@ func TestBuildGetter(t *testing.T) {
 func TestRequestBodyGetter(t *testing.T) {
 	target := "targetstring"
 	pair := httpsource.RequestResponsePair{RequestBody: []byte(target)}
-	if v, err := requestBodyGetter(&pair); v != target || err != nil {
+	if v, err := requestBodyGetter(&pair); !equalValues(v, []string{target}) || err != nil {
 		t.Errorf("Expected %s, got %s.\n", target, v)
 	}
 }
@@ -28,16 +28,25 @@ func TestHeaderGetterFull(t *testing.T) {
 	ct := "text/plain"
 	req := http.Request{Header: make(http.Header)}
 	req.Header["Content-Type"] = []string{ct}
+	req.Header["X-Forwarded-For"] = []string{"10.0.0.1, 192.0.2.1", "198.51.100.7"}
+	req.Header["User-Agent"] = []string{"Mozilla/5.0 (X11, Linux)"}
+	req.Header["X-Custom"] = []string{"a, b", "c"}
+	req.Header["Accept-Encoding"] = []string{"gzip, br"}
 	resp := http.Response{Header: make(http.Header)}
 	resp.Header["Content-Type"] = []string{ct}
 	pair := httpsource.RequestResponsePair{Request: &req, Response: &resp}
 
 	expected := []struct {
-		getter, value string
+		getter string
+		value  []string
 	}{
-		{"request.header.Content-Type", ct},
-		{"request.header.missing", ""},
-		{"response.header.content-type", ct},
+		{"request.header.Content-Type", []string{ct}},
+		{"request.header.missing", []string{""}},
+		{"request.header.x-forwarded-for", []string{"10.0.0.1", "192.0.2.1", "198.51.100.7"}},
+		{"request.header.user-agent", []string{"Mozilla/5.0 (X11, Linux)"}},
+		{"request.header.x-custom", []string{"a, b", "c"}},
+		{"request.header.accept-encoding", []string{"gzip", "br"}},
+		{"response.header.content-type", []string{ct}},
 	}
 
 	for _, test := range expected {
@@ -49,7 +58,7 @@ func TestHeaderGetterFull(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error parsing header: %v\n", err)
 		}
-		if val != test.value {
+		if !equalValues(val, test.value) {
 			t.Errorf("%v: Expected %s, got %s.\n", test.getter, test.value, val)
 		}
 	}
@@ -81,7 +90,7 @@ func TestURLPartGetters(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error getting val: %v\n", err)
 		}
-		if val != test.value {
+		if !equalValues(val, []string{test.value}) {
 			t.Errorf("Got %v, expected %v.\n", val, test.value)
 		}
 	}
@@ -106,11 +115,37 @@ func TestURLGetter(t *testing.T) {
 	if err != nil {
 		t.Errorf("Expected no error, got %v\n", err)
 	}
-	if val != uri {
+	if !equalValues(val, []string{uri}) {
 		t.Errorf("Expected %v, got %v\n", uri, val)
 	}
 }
 
+func TestEventGetters(t *testing.T) {
+	ev := httpsource.ServerSentEvent{ID: "4", Event: "update", Data: "payload", Retry: 500}
+	pair := httpsource.RequestResponsePair{Event: &ev}
+	tests := []struct {
+		field, value string
+	}{
+		{"id", "4"},
+		{"event", "update"},
+		{"data", "payload"},
+		{"retry", "500"},
+	}
+	for _, test := range tests {
+		g, err := buildGetter("response.event." + test.field)
+		if err != nil {
+			t.Fatalf("Error building: %v\n", err)
+		}
+		if val, err := g(&pair); err != nil || !equalValues(val, []string{test.value}) {
+			t.Errorf("Got %v (%v), expected %v.\n", val, err, test.value)
+		}
+	}
+	g, _ := buildGetter("response.event.data")
+	if _, err := g(&httpsource.RequestResponsePair{}); err == nil {
+		t.Errorf("Expected an error for a pair without an event.\n")
+	}
+}
+
 func requestFromURI(uri string) (*http.Request, error) {
 	body := strings.NewReader("<html>")
 	return http.NewRequest("GET", uri, body)
@@ -0,0 +1,274 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Descriptors for decoding gRPC messages, set by LoadProtoDescriptors.
+var protoFiles *protoregistry.Files
+
+// grpcCall is the decoded view of a gRPC or gRPC-Web pair.  The bodies hold
+// one JSON value per message, and are only set if a descriptor for the method
+// was loaded.
+type grpcCall struct {
+	Service      string
+	Method       string
+	Status       string
+	RequestJSON  []string
+	ResponseJSON []string
+}
+
+type grpcFrame struct {
+	flags byte
+	data  []byte
+}
+
+const (
+	grpcFlagCompressed = 0x01
+	grpcFlagTrailers   = 0x80
+)
+
+// Compressed messages larger than this when decompressed are dropped, as in
+// the default limit of gRPC servers.
+const maxGRPCMessageSize = 4 << 20
+
+// LoadProtoDescriptors loads FileDescriptorSet files (as produced by
+// `protoc --include_imports --descriptor_set_out`) used to decode gRPC
+// messages.  Files may depend on each other in any order.
+func LoadProtoDescriptors(filenames ...string) error {
+	if len(filenames) == 0 {
+		return nil
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	for _, fname := range filenames {
+		buf, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		fds := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(buf, fds); err != nil {
+			return fmt.Errorf("Unable to parse %s: %v", fname, err)
+		}
+		for _, fd := range fds.File {
+			if !seen[fd.GetName()] {
+				seen[fd.GetName()] = true
+				set.File = append(set.File, fd)
+			}
+		}
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return err
+	}
+	protoFiles = files
+	return nil
+}
+
+// isGRPC returns true if the content type is one used by gRPC or gRPC-Web.
+func isGRPC(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == "application/grpc" || strings.HasPrefix(mt, "application/grpc+") ||
+		strings.HasPrefix(mt, "application/grpc-web")
+}
+
+// getGRPCCall decodes the pair once, returning nil if it is not gRPC.
+func getGRPCCall(pair *httpsource.RequestResponsePair) *grpcCall {
+	if pair.Request == nil || !isGRPC(pair.Request.Header.Get("Content-Type")) {
+		return nil
+	}
+	return pair.Memoize("grpc", func() interface{} {
+		return decodeGRPCCall(pair)
+	}).(*grpcCall)
+}
+
+func decodeGRPCCall(pair *httpsource.RequestResponsePair) *grpcCall {
+	call := &grpcCall{}
+	if pair.Request.URL != nil {
+		parts := strings.Split(strings.TrimPrefix(pair.Request.URL.Path, "/"), "/")
+		if len(parts) == 2 {
+			call.Service, call.Method = parts[0], parts[1]
+		}
+	}
+
+	var method protoreflect.MethodDescriptor
+	if protoFiles != nil && call.Service != "" {
+		if d, err := protoFiles.FindDescriptorByName(protoreflect.FullName(call.Service)); err == nil {
+			if sd, ok := d.(protoreflect.ServiceDescriptor); ok {
+				method = sd.Methods().ByName(protoreflect.Name(call.Method))
+			}
+		}
+	}
+
+	frames, err := readGRPCFrames(pair.RequestBody, pair.Request.Header)
+	if err != nil {
+		logger.Printf("Unable to read gRPC request: %v\n", err)
+	} else if method != nil {
+		call.RequestJSON = grpcFramesToJSON(frames, method.Input())
+	}
+
+	if resp := pair.Response; resp != nil {
+		frames, err := readGRPCFrames(pair.ResponseBody, resp.Header)
+		if err != nil {
+			logger.Printf("Unable to read gRPC response: %v\n", err)
+		} else if method != nil {
+			call.ResponseJSON = grpcFramesToJSON(frames, method.Output())
+		}
+		// gRPC-Web carries trailers in the body
+		for _, f := range frames {
+			if f.flags&grpcFlagTrailers == 0 {
+				continue
+			}
+			tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(f.data, "\r\n\r\n"...))))
+			if hdr, err := tr.ReadMIMEHeader(); err == nil && hdr.Get("Grpc-Status") != "" {
+				call.Status = hdr.Get("Grpc-Status")
+			}
+		}
+		if call.Status == "" {
+			call.Status = resp.Trailer.Get("Grpc-Status")
+		}
+		if call.Status == "" {
+			// Trailers-Only responses
+			call.Status = resp.Header.Get("Grpc-Status")
+		}
+	}
+	return call
+}
+
+// readGRPCFrames splits a body into length-prefixed messages, decompressing
+// them as needed.
+func readGRPCFrames(body []byte, hdr http.Header) ([]grpcFrame, error) {
+	if strings.HasPrefix(hdr.Get("Content-Type"), "application/grpc-web-text") {
+		var err error
+		if body, err = decodeGRPCWebText(body); err != nil {
+			return nil, err
+		}
+	}
+	var frames []grpcFrame
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return frames, errors.New("Truncated gRPC frame header")
+		}
+		f := grpcFrame{flags: body[0]}
+		size := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(size) {
+			return frames, errors.New("Truncated gRPC message")
+		}
+		f.data, body = body[5:5+size], body[5+size:]
+		if f.flags&grpcFlagCompressed != 0 && f.flags&grpcFlagTrailers == 0 {
+			encoding := hdr.Get("Grpc-Encoding")
+			if encoding != "gzip" {
+				return frames, fmt.Errorf("Unsupported gRPC encoding: %s", encoding)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(f.data))
+			if err != nil {
+				return frames, err
+			}
+			if f.data, err = ioutil.ReadAll(io.LimitReader(zr, maxGRPCMessageSize+1)); err != nil {
+				return frames, err
+			}
+			if len(f.data) > maxGRPCMessageSize {
+				return frames, fmt.Errorf("gRPC message exceeds %d bytes when decompressed", maxGRPCMessageSize)
+			}
+		}
+		frames = append(frames, f)
+	}
+	return frames, nil
+}
+
+// gRPC-Web text bodies are base64, possibly as several padded chunks.
+func decodeGRPCWebText(body []byte) ([]byte, error) {
+	var out []byte
+	text := strings.Join(strings.Fields(string(body)), "")
+	for len(text) > 0 {
+		end := strings.IndexByte(text, '=')
+		if end == -1 {
+			end = len(text)
+		} else {
+			for end < len(text) && text[end] == '=' {
+				end++
+			}
+		}
+		chunk, err := base64.StdEncoding.DecodeString(text[:end])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		text = text[end:]
+	}
+	return out, nil
+}
+
+// grpcFramesToJSON converts the messages to compact JSON.
+func grpcFramesToJSON(frames []grpcFrame, desc protoreflect.MessageDescriptor) []string {
+	msgs := []string{}
+	for _, f := range frames {
+		if f.flags&grpcFlagTrailers != 0 {
+			continue
+		}
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(f.data, msg); err != nil {
+			logger.Printf("Unable to decode %s: %v\n", desc.FullName(), err)
+			return nil
+		}
+		buf, err := protojson.Marshal(msg)
+		if err != nil {
+			logger.Printf("Unable to encode %s: %v\n", desc.FullName(), err)
+			return nil
+		}
+		// protojson output is deliberately unstable, so normalize it
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, buf); err != nil {
+			return nil
+		}
+		msgs = append(msgs, compact.String())
+	}
+	return msgs
+}
+
+// Build getters for the grpc.* fields
+func buildGRPCGetter(field string) (FieldGetter, error) {
+	var getter func(call *grpcCall) string
+	switch field {
+	case "service":
+		getter = func(call *grpcCall) string { return call.Service }
+	case "method":
+		getter = func(call *grpcCall) string { return call.Method }
+	case "status":
+		getter = func(call *grpcCall) string { return call.Status }
+	default:
+		return nil, fmt.Errorf("Unknown field: %s", field)
+	}
+
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		call := getGRPCCall(pair)
+		if call == nil {
+			return nil, errors.New("Not a gRPC request")
+		}
+		return []string{getter(call)}, nil
+	}, nil
+}
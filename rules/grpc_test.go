@@ -0,0 +1,179 @@
+package rules
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/Matir/httpwatch/httpsource"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a descriptor set for:
+//
+//	package test;
+//	message User { string name = 1; string role = 2; }
+//	service Users { rpc Get(User) returns (User); }
+func writeTestDescriptors(t *testing.T) string {
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+	opt := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("User"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(1), Type: &str, Label: &opt},
+				{Name: proto.String("role"), JsonName: proto.String("role"), Number: proto.Int32(2), Type: &str, Label: &opt},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Users"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Get"),
+				InputType:  proto.String(".test.User"),
+				OutputType: proto.String(".test.User"),
+			}},
+		}},
+	}
+	buf, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "test.pb")
+	if err := ioutil.WriteFile(fname, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func grpcFrameBytes(flags byte, msg []byte) []byte {
+	hdr := make([]byte, 5)
+	hdr[0] = flags
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	return append(hdr, msg...)
+}
+
+func encodeTestUser(t *testing.T, name, role string) []byte {
+	d, err := protoFiles.FindDescriptorByName("test.User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := d.(protoreflect.MessageDescriptor)
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(desc.Fields().ByName("name"), protoreflect.ValueOfString(name))
+	msg.Set(desc.Fields().ByName("role"), protoreflect.ValueOfString(role))
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestGRPCGetters(t *testing.T) {
+	if err := LoadProtoDescriptors(writeTestDescriptors(t)); err != nil {
+		t.Fatalf("Unable to load descriptors: %v\n", err)
+	}
+	defer func() { protoFiles = nil }()
+
+	req, _ := http.NewRequest("POST", "http://example.com/test.Users/Get", nil)
+	req.Header.Set("Content-Type", "application/grpc-web-text")
+	resp := &http.Response{Header: make(http.Header)}
+	resp.Header.Set("Content-Type", "application/grpc-web+proto")
+	reqBody := grpcFrameBytes(0, encodeTestUser(t, "bob", ""))
+	var respBody bytes.Buffer
+	respBody.Write(grpcFrameBytes(0, encodeTestUser(t, "bob", "admin")))
+	respBody.Write(grpcFrameBytes(grpcFlagTrailers, []byte("grpc-status: 7\r\ngrpc-message: denied\r\n")))
+	pair := &httpsource.RequestResponsePair{
+		Request:      req,
+		RequestBody:  []byte(base64.StdEncoding.EncodeToString(reqBody)),
+		Response:     resp,
+		ResponseBody: respBody.Bytes(),
+	}
+
+	tests := []struct {
+		field, value string
+	}{
+		{"grpc.service", "test.Users"},
+		{"grpc.method", "Get"},
+		{"grpc.status", "7"},
+		{"request.body", `{"name":"bob"}`},
+		{"response.body", `{"name":"bob","role":"admin"}`},
+		{"request.json.$.name", "bob"},
+		{"response.json.$.role", "admin"},
+	}
+	for _, test := range tests {
+		g, err := buildGetter(test.field)
+		if err != nil {
+			t.Fatalf("Error building %s: %v\n", test.field, err)
+		}
+		if val, err := g(pair); err != nil || !equalValues(val, []string{test.value}) {
+			t.Errorf("%s: expected %v, got %v (%v)\n", test.field, test.value, val, err)
+		}
+	}
+
+	// A document per message of a stream
+	stream := append(grpcFrameBytes(0, encodeTestUser(t, "bob", "")), grpcFrameBytes(0, encodeTestUser(t, "carol", "ops"))...)
+	req.Header.Set("Content-Type", "application/grpc")
+	checkGetters(t, &httpsource.RequestResponsePair{Request: req, RequestBody: stream}, []getterTest{
+		{"request.body", []string{`{"name":"bob"}`, `{"name":"carol","role":"ops"}`}},
+		{"request.json.$.name", []string{"bob", "carol"}},
+		{"request.json.$.role", []string{"ops"}},
+	})
+}
+
+func TestGRPCStatusFromTrailer(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/test.Users/Get", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp := &http.Response{Header: make(http.Header), Trailer: make(http.Header)}
+	resp.Trailer.Set("Grpc-Status", "0")
+	pair := &httpsource.RequestResponsePair{Request: req, RequestBody: []byte("raw"), Response: resp}
+	g, _ := buildGetter("grpc.status")
+	if val, err := g(pair); err != nil || !equalValues(val, []string{"0"}) {
+		t.Errorf("Expected status 0, got %v (%v)\n", val, err)
+	}
+	// Without descriptors the raw body is returned
+	if val, _ := requestBodyGetter(pair); !equalValues(val, []string{"raw"}) {
+		t.Errorf("Expected raw body, got %v\n", val)
+	}
+	pair.Request.Header.Set("Content-Type", "text/plain")
+	if _, err := g(&httpsource.RequestResponsePair{Request: pair.Request}); err == nil {
+		t.Errorf("Expected error for non-gRPC request.\n")
+	}
+}
+
+func gzipBytes(buf []byte) []byte {
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	zw.Write(buf)
+	zw.Close()
+	return out.Bytes()
+}
+
+func TestGRPCDecompressionLimit(t *testing.T) {
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", "application/grpc")
+	hdr.Set("Grpc-Encoding", "gzip")
+	var body bytes.Buffer
+	body.Write(grpcFrameBytes(grpcFlagCompressed, gzipBytes([]byte("small"))))
+	body.Write(grpcFrameBytes(grpcFlagCompressed, gzipBytes(make([]byte, maxGRPCMessageSize+1))))
+	frames, err := readGRPCFrames(body.Bytes(), hdr)
+	if err == nil {
+		t.Errorf("Expected an error for an oversized message.\n")
+	}
+	if len(frames) != 1 || string(frames[0].data) != "small" {
+		t.Errorf("Expected only the small frame, got %d frames\n", len(frames))
+	}
+	frames, err = readGRPCFrames(grpcFrameBytes(grpcFlagCompressed, gzipBytes(make([]byte, maxGRPCMessageSize))), hdr)
+	if err != nil || len(frames) != 1 || len(frames[0].data) != maxGRPCMessageSize {
+		t.Errorf("Expected a message at the limit to decompress, got %v\n", err)
+	}
+}
@@ -0,0 +1,230 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a compiled subset of JSONPath: $, .name, ['name'], [n],
+// [*], .* and ..name for recursive descent.
+type jsonPath []jsonPathStep
+
+type jsonPathStep struct {
+	kind  int
+	name  string
+	index int
+}
+
+const (
+	jsonStepChild = iota
+	jsonStepIndex
+	jsonStepWildcard
+	jsonStepRecursive
+)
+
+// compileJSONPath parses a path such as $.users[*].role.  The leading $ is
+// optional.
+func compileJSONPath(path string) (jsonPath, error) {
+	orig := path
+	path = strings.TrimPrefix(path, "$")
+	var steps jsonPath
+	for len(path) > 0 {
+		switch {
+		case strings.HasPrefix(path, ".."):
+			name, rest := splitJSONName(path[2:])
+			if name == "" {
+				return nil, fmt.Errorf("Missing name after .. in %s", orig)
+			}
+			steps = append(steps, jsonPathStep{kind: jsonStepRecursive, name: name})
+			path = rest
+		case path[0] == '.':
+			name, rest := splitJSONName(path[1:])
+			switch name {
+			case "":
+				return nil, fmt.Errorf("Empty name in %s", orig)
+			case "*":
+				steps = append(steps, jsonPathStep{kind: jsonStepWildcard})
+			default:
+				steps = append(steps, jsonPathStep{kind: jsonStepChild, name: name})
+			}
+			path = rest
+		case path[0] == '[':
+			end := strings.IndexByte(path, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated [ in %s", orig)
+			}
+			sel := strings.TrimSpace(path[1:end])
+			switch {
+			case sel == "*":
+				steps = append(steps, jsonPathStep{kind: jsonStepWildcard})
+			case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+				steps = append(steps, jsonPathStep{kind: jsonStepChild, name: sel[1 : len(sel)-1]})
+			default:
+				idx, err := strconv.Atoi(sel)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid selector [%s] in %s", sel, orig)
+				}
+				steps = append(steps, jsonPathStep{kind: jsonStepIndex, index: idx})
+			}
+			path = path[end+1:]
+		default:
+			// Allow the first name without a leading dot
+			if len(steps) > 0 || len(orig) != len(path) {
+				return nil, fmt.Errorf("Unexpected %q in %s", path[0], orig)
+			}
+			path = "." + path
+		}
+	}
+	return steps, nil
+}
+
+func splitJSONName(path string) (string, string) {
+	end := strings.IndexAny(path, ".[")
+	if end == -1 {
+		return path, ""
+	}
+	return path[:end], path[end:]
+}
+
+// Eval returns every value in doc matched by the path.  Object members are
+// visited in key order, since decoding does not preserve their order.
+func (p jsonPath) Eval(doc interface{}) []interface{} {
+	nodes := []interface{}{doc}
+	for _, step := range p {
+		var next []interface{}
+		for _, n := range nodes {
+			next = step.apply(n, next)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+func (s jsonPathStep) apply(node interface{}, out []interface{}) []interface{} {
+	switch s.kind {
+	case jsonStepChild:
+		if obj, ok := node.(map[string]interface{}); ok {
+			if v, ok := obj[s.name]; ok {
+				out = append(out, v)
+			}
+		}
+	case jsonStepIndex:
+		if arr, ok := node.([]interface{}); ok {
+			idx := s.index
+			if idx < 0 {
+				idx += len(arr)
+			}
+			if idx >= 0 && idx < len(arr) {
+				out = append(out, arr[idx])
+			}
+		}
+	case jsonStepWildcard:
+		out = append(out, jsonChildren(node)...)
+	case jsonStepRecursive:
+		child := jsonPathStep{kind: jsonStepChild, name: s.name}
+		if s.name == "*" {
+			child = jsonPathStep{kind: jsonStepWildcard}
+		}
+		out = child.apply(node, out)
+		for _, c := range jsonChildren(node) {
+			out = s.apply(c, out)
+		}
+	}
+	return out
+}
+
+// Children of an object (ordered by key) or array.
+func jsonChildren(node interface{}) []interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		children := make([]interface{}, 0, len(n))
+		for _, k := range keys {
+			children = append(children, n[k])
+		}
+		return children
+	case []interface{}:
+		return n
+	}
+	return nil
+}
+
+// jsonDocuments are the parsed documents of a body, or the error from
+// parsing it.
+type jsonDocuments struct {
+	docs []interface{}
+	err  error
+}
+
+// getJSONBodies parses the request or response body once per pair.  gRPC
+// bodies decoded with a descriptor have a document per message, as returned
+// by request.body and response.body.
+func getJSONBodies(pair *httpsource.RequestResponsePair, rr string) ([]interface{}, error) {
+	d := pair.Memoize("json."+rr, func() interface{} {
+		bodies := [][]byte{pairBody(pair, rr)}
+		if call := getGRPCCall(pair); call != nil {
+			msgs := call.RequestJSON
+			if rr == "response" {
+				msgs = call.ResponseJSON
+			}
+			if msgs != nil {
+				bodies = bodies[:0]
+				for _, m := range msgs {
+					bodies = append(bodies, []byte(m))
+				}
+			}
+		}
+		res := &jsonDocuments{}
+		for _, body := range bodies {
+			var doc interface{}
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+			if err := dec.Decode(&doc); err != nil {
+				return &jsonDocuments{err: fmt.Errorf("Body is not JSON: %v", err)}
+			}
+			res.docs = append(res.docs, doc)
+		}
+		return res
+	}).(*jsonDocuments)
+	return d.docs, d.err
+}
+
+// jsonValueString returns strings as-is and other values as compact JSON.
+func jsonValueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+// Build a getter for request.json.<path> and response.json.<path>, with a
+// value for every match in every document of the body.
+func buildJSONPathGetter(rr, path string) (FieldGetter, error) {
+	p, err := compileJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		docs, err := getJSONBodies(pair, rr)
+		if err != nil {
+			return nil, err
+		}
+		var vals []string
+		for _, doc := range docs {
+			for _, m := range p.Eval(doc) {
+				vals = append(vals, jsonValueString(m))
+			}
+		}
+		return vals, nil
+	}, nil
+}
@@ -0,0 +1,45 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"testing"
+)
+
+func TestCompileJSONPath(t *testing.T) {
+	valid := []string{"$", "$.user.role", "user.role", "$.items[*].id", "$['user']", "$..id", "$.items[-1]", "$.*"}
+	for _, p := range valid {
+		if _, err := compileJSONPath(p); err != nil {
+			t.Errorf("%s: unexpected error %v\n", p, err)
+		}
+	}
+	invalid := []string{"$.", "$[", "$[x]", "$..", "$user"}
+	for _, p := range invalid {
+		if _, err := compileJSONPath(p); err == nil {
+			t.Errorf("%s: expected an error\n", p)
+		}
+	}
+}
+
+func TestJSONPathGetter(t *testing.T) {
+	body := `{"user": {"role": "admin", "id": 7, "active": true},
+		"items": [{"id": 1, "tags": ["a"]}, {"id": 2}, {"name": "x"}]}`
+	pair := &httpsource.RequestResponsePair{RequestBody: []byte(body), ResponseBody: []byte("not json")}
+	checkGetters(t, pair, []getterTest{
+		{"request.json.$.user.role", []string{"admin"}},
+		{"request.json.user.id", []string{"7"}},
+		{"request.json.$.user.active", []string{"true"}},
+		{"request.json.$['user']['role']", []string{"admin"}},
+		{"request.json.$.items[*].id", []string{"1", "2"}},
+		{"request.json.$.items[-1].name", []string{"x"}},
+		{"request.json.$.items[0].tags", []string{`["a"]`}},
+		{"request.json.$..id", []string{"1", "2", "7"}},
+		{"request.json.$.missing", nil},
+	})
+	g, err := buildGetter("response.json.$.user")
+	if err != nil {
+		t.Fatalf("Error building getter: %v\n", err)
+	}
+	if _, err := g(pair); err == nil {
+		t.Errorf("Expected an error for a non-JSON body.\n")
+	}
+}
@@ -0,0 +1,378 @@
+package rules
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JWTs are found in Bearer Authorization headers and cookies of requests,
+// and in cookies set by responses.  They are decoded without verification;
+// if a JWKS is loaded, the verified field also reports whether the
+// signature is valid.
+
+// jwtToken is a decoded JWS in compact form.
+type jwtToken struct {
+	header    map[string]interface{}
+	claims    map[string]interface{}
+	signed    string
+	signature []byte
+}
+
+// Keys for verifying signatures, set by LoadJWKS.
+var jwksKeys []*jwk
+
+// jwk is a public (or for HMAC, secret) key from a JWKS.
+type jwk struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// decodeJWT decodes a compact JWS, returning nil if it is not one.
+func decodeJWT(s string) *jwtToken {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	tok := &jwtToken{signed: parts[0] + "." + parts[1]}
+	if decodeJWTPart(parts[0], &tok.header) != nil || decodeJWTPart(parts[1], &tok.claims) != nil {
+		return nil
+	}
+	if _, ok := tok.header["alg"].(string); !ok {
+		return nil
+	}
+	sig, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil
+	}
+	tok.signature = sig
+	return tok
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Numbers are kept as json.Number, so that times are reported as written.
+func decodeJWTPart(s string, v *map[string]interface{}) error {
+	buf, err := decodeBase64URL(s)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if *v == nil {
+		return errors.New("JWT part is not an object")
+	}
+	return nil
+}
+
+// findJWTs returns the tokens in the Bearer Authorization headers and the
+// cookies of the request, or the cookies set by the response.
+func findJWTs(pair *httpsource.RequestResponsePair, rr string) []*jwtToken {
+	var candidates []string
+	if rr == "request" {
+		if pair.Request == nil {
+			return nil
+		}
+		for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+			for _, v := range pair.Request.Header[name] {
+				if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+					candidates = append(candidates, strings.TrimSpace(v[7:]))
+				}
+			}
+		}
+		for _, c := range getRequestCookies(pair) {
+			candidates = append(candidates, c.Value)
+		}
+	} else {
+		for _, c := range getResponseCookies(pair) {
+			candidates = append(candidates, c.Value)
+		}
+	}
+	var tokens []*jwtToken
+	for _, c := range candidates {
+		// Every JWS starts with a base64 encoded {"
+		if !strings.HasPrefix(c, "ey") {
+			continue
+		}
+		if tok := decodeJWT(c); tok != nil {
+			tokens = append(tokens, tok)
+		}
+	}
+	return tokens
+}
+
+// getJWTs decodes the tokens in the request or response once per pair.
+func getJWTs(pair *httpsource.RequestResponsePair, rr string) []*jwtToken {
+	return pair.Memoize("jwt."+rr, func() interface{} {
+		return findJWTs(pair, rr)
+	}).([]*jwtToken)
+}
+
+// Build a getter for request.jwt.<attribute> or response.jwt.<attribute>,
+// with a value for each token: header.<name> or claims.<name> for a member
+// of the header or claims (with each element of an array as a value, and
+// nested members as claims.<name>.<member>), expired for true or false by
+// the exp claim at the time of the request, or verified for true or false by
+// the signature and the loaded JWKS.
+func buildJWTGetter(rr, attribute string) (FieldGetter, error) {
+	var getter func(pair *httpsource.RequestResponsePair, tok *jwtToken) []string
+	switch part, name, _ := splitFirst(attribute, "."); {
+	case attribute == "expired":
+		getter = jwtExpired
+	case attribute == "verified":
+		if len(jwksKeys) == 0 {
+			return nil, errors.New("No JWKS loaded to verify tokens")
+		}
+		getter = func(_ *httpsource.RequestResponsePair, tok *jwtToken) []string {
+			return []string{strconv.FormatBool(tok.verify())}
+		}
+	case part == "header" && name != "":
+		getter = func(_ *httpsource.RequestResponsePair, tok *jwtToken) []string {
+			return jwtMember(tok.header, name)
+		}
+	case part == "claims" && name != "":
+		getter = func(_ *httpsource.RequestResponsePair, tok *jwtToken) []string {
+			return jwtMember(tok.claims, name)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown JWT field: %s", attribute)
+	}
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		var vals []string
+		for _, tok := range getJWTs(pair, rr) {
+			vals = append(vals, getter(pair, tok)...)
+		}
+		return vals, nil
+	}, nil
+}
+
+// jwtMember looks up a member by name, or by a path of names separated by
+// dots for nested objects.  Names containing dots, such as URIs, are tried
+// whole first.
+func jwtMember(obj map[string]interface{}, name string) []string {
+	v, ok := obj[name]
+	if !ok {
+		for i := 0; i < len(name); i++ {
+			if name[i] != '.' {
+				continue
+			}
+			if sub, ok := obj[name[:i]].(map[string]interface{}); ok {
+				if vals := jwtMember(sub, name[i+1:]); vals != nil {
+					return vals
+				}
+			}
+		}
+		return nil
+	}
+	if list, ok := v.([]interface{}); ok {
+		vals := make([]string, len(list))
+		for i, elem := range list {
+			vals[i] = jsonValueString(elem)
+		}
+		return vals
+	}
+	return []string{jsonValueString(v)}
+}
+
+// Tokens without an exp claim have no value.
+func jwtExpired(pair *httpsource.RequestResponsePair, tok *jwtToken) []string {
+	exp, ok := tok.claims["exp"].(json.Number)
+	if !ok {
+		return nil
+	}
+	secs, err := exp.Float64()
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return nil
+	}
+	now := pair.RequestTime
+	if now.IsZero() {
+		now = time.Now()
+	}
+	// Beyond the range of time.Time, far past or far future
+	if math.Abs(secs) >= 1<<62 {
+		return []string{strconv.FormatBool(secs < 0)}
+	}
+	sec, frac := math.Modf(secs)
+	expires := time.Unix(int64(sec), int64(frac*1e9))
+	return []string{strconv.FormatBool(!now.Before(expires))}
+}
+
+// LoadJWKS loads the keys used to verify tokens from a JSON Web Key Set file.
+// Encryption keys are ignored.
+func LoadJWKS(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(buf)
+	if err != nil {
+		return fmt.Errorf("Unable to parse %s: %v", filename, err)
+	}
+	jwksKeys = keys
+	return nil
+}
+
+func parseJWKS(buf []byte) ([]*jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty, Kid, Use, Alg, Crv string
+			N, E, X, Y, K           string
+		}
+	}
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, err
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("No keys in JWKS")
+	}
+	var keys []*jwk
+	for i, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			var n, e []byte
+			if n, err = decodeBase64URL(k.N); err == nil {
+				if e, err = decodeBase64URL(k.E); err == nil {
+					key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+				}
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("Key %d: unsupported curve %s", i, k.Crv)
+			}
+			var x, y []byte
+			if x, err = decodeBase64URL(k.X); err == nil {
+				if y, err = decodeBase64URL(k.Y); err == nil {
+					key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+				}
+			}
+		case "OKP":
+			if k.Crv != "Ed25519" {
+				return nil, fmt.Errorf("Key %d: unsupported curve %s", i, k.Crv)
+			}
+			var x []byte
+			if x, err = decodeBase64URL(k.X); err == nil {
+				if len(x) != ed25519.PublicKeySize {
+					err = errors.New("invalid key size")
+				}
+				key = ed25519.PublicKey(x)
+			}
+		case "oct":
+			key, err = decodeBase64URL(k.K)
+		default:
+			return nil, fmt.Errorf("Key %d: unsupported key type %s", i, k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Key %d: %v", i, err)
+		}
+		keys = append(keys, &jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+// verify returns true if any key from the JWKS, matching the kid of the token
+// if it has one, verifies the signature.  Unsigned tokens never verify.
+func (tok *jwtToken) verify() bool {
+	alg, _ := tok.header["alg"].(string)
+	kid, _ := tok.header["kid"].(string)
+	for _, k := range jwksKeys {
+		if (kid != "" && k.kid != kid) || (k.alg != "" && k.alg != alg) {
+			continue
+		}
+		if k.verify(alg, []byte(tok.signed), tok.signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *jwk) verify(alg string, signed, sig []byte) bool {
+	if alg == "EdDSA" {
+		pub, ok := k.key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	}
+	if len(alg) != 5 {
+		return false
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "HS":
+		secret, ok := k.key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case "RS":
+		pub, ok := k.key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case "PS":
+		pub, ok := k.key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		pub, ok := k.key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package rules
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/Matir/httpwatch/httpsource"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func b64(buf []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// makeJWT encodes a token, signing it with sign if it is set.
+func makeJWT(header, claims string, sign func(signed []byte) []byte) string {
+	signed := b64([]byte(header)) + "." + b64([]byte(claims))
+	if sign == nil {
+		return signed + "."
+	}
+	return signed + "." + b64(sign([]byte(signed)))
+}
+
+func TestJWTGetters(t *testing.T) {
+	reqTime := time.Unix(1700000000, 0)
+	bearer := makeJWT(`{"alg":"none","typ":"JWT"}`, `{"sub":"admin","iss":"https://idp.example.com","exp":1600000000,"aud":["api","web"],"realm":{"roles":["ops"]},"https://example.com/tenant":"acme"}`, nil)
+	cookie := makeJWT(`{"alg":"HS256"}`, `{"sub":"bob","exp":1800000000}`, func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	})
+
+	req, _ := requestFromURI("http://example.com/")
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	req.Header.Add("Cookie", "session="+cookie+"; theme=eyJdark")
+	resp := &http.Response{Header: make(http.Header)}
+	resp.Header.Add("Set-Cookie", "token="+makeJWT(`{"alg":"RS256","kid":"k1"}`, `{"sub":"carol"}`, func([]byte) []byte { return []byte("sig") }))
+	pair := &httpsource.RequestResponsePair{Request: req, Response: resp, RequestTime: reqTime}
+	checkGetters(t, pair, []getterTest{
+		{"request.jwt.header.alg", []string{"none", "HS256"}},
+		{"request.jwt.header.typ", []string{"JWT"}},
+		{"request.jwt.claims.sub", []string{"admin", "bob"}},
+		{"request.jwt.claims.iss", []string{"https://idp.example.com"}},
+		{"request.jwt.claims.aud", []string{"api", "web"}},
+		{"request.jwt.claims.exp", []string{"1600000000", "1800000000"}},
+		{"request.jwt.claims.realm.roles", []string{"ops"}},
+		{"request.jwt.claims.https://example.com/tenant", []string{"acme"}},
+		{"request.jwt.expired", []string{"true", "false"}},
+		{"response.jwt.header.kid", []string{"k1"}},
+		{"response.jwt.claims.sub", []string{"carol"}},
+		{"response.jwt.expired", nil},
+	})
+
+	// Expiry times beyond the range of time.Duration
+	for exp, expected := range map[string]string{"1e12": "false", "99999999999999999999": "false", "1699999999.5": "true", "-1e30": "true"} {
+		tok := decodeJWT(makeJWT(`{"alg":"none"}`, `{"exp":`+exp+`}`, nil))
+		if res := jwtExpired(pair, tok); !equalValues(res, []string{expected}) {
+			t.Errorf("exp %s: expected %s, got %v\n", exp, expected, res)
+		}
+	}
+
+	for _, field := range []string{"request.jwt.verified", "request.jwt.payload", "request.jwt.claims"} {
+		if _, err := buildGetter(field); err == nil {
+			t.Errorf("Expected an error for %s\n", field)
+		}
+	}
+	for _, s := range []string{"eyJhbGciOiJub25lIn0", "eyJhbGciOiJub25lIn0.W10.", "eyJ0eXAiOiJKV1QifQ.e30.", "a.b.c.d.e"} {
+		if tok := decodeJWT(s); tok != nil {
+			t.Errorf("Expected %s not to decode\n", s)
+		}
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub)},
+		{"kty": "oct", "kid": "hmac", "alg": "HS256", "k": b64([]byte("secret"))},
+		{"kty": "RSA", "use": "enc", "n": "", "e": ""},
+	}
+	buf, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	parsed, err := parseJWKS(buf)
+	if err != nil || len(parsed) != 4 {
+		t.Fatalf("Unable to parse JWKS: %v %v\n", parsed, err)
+	}
+	oldKeys := jwksKeys
+	jwksKeys = parsed
+	defer func() { jwksKeys = oldKeys }()
+
+	digest := func(signed []byte) []byte {
+		h := sha256.Sum256(signed)
+		return h[:]
+	}
+	signRSA := func(signed []byte) []byte {
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest(signed))
+		return sig
+	}
+	signPSS := func(signed []byte) []byte {
+		sig, _ := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest(signed), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		return sig
+	}
+	signEC := func(signed []byte) []byte {
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest(signed))
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+	signEd := func(signed []byte) []byte {
+		return ed25519.Sign(edKey, signed)
+	}
+	signHMAC := func(secret string) func([]byte) []byte {
+		return func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(signed)
+			return mac.Sum(nil)
+		}
+	}
+
+	tests := []struct {
+		token    string
+		expected bool
+	}{
+		{makeJWT(`{"alg":"RS256","kid":"rsa"}`, `{"sub":"a"}`, signRSA), true},
+		{makeJWT(`{"alg":"RS256"}`, `{"sub":"a"}`, signRSA), true},
+		{makeJWT(`{"alg":"RS256","kid":"ec"}`, `{"sub":"a"}`, signRSA), false},
+		{makeJWT(`{"alg":"PS256","kid":"rsa"}`, `{"sub":"a"}`, signPSS), true},
+		{makeJWT(`{"alg":"ES256","kid":"ec"}`, `{"sub":"a"}`, signEC), true},
+		{makeJWT(`{"alg":"EdDSA","kid":"ed"}`, `{"sub":"a"}`, signEd), true},
+		{makeJWT(`{"alg":"HS256","kid":"hmac"}`, `{"sub":"a"}`, signHMAC("secret")), true},
+		{makeJWT(`{"alg":"HS256","kid":"hmac"}`, `{"sub":"a"}`, signHMAC("guess")), false},
+		{makeJWT(`{"alg":"HS384","kid":"hmac"}`, `{"sub":"a"}`, signHMAC("secret")), false},
+		{makeJWT(`{"alg":"none"}`, `{"sub":"a"}`, nil), false},
+	}
+	for i, test := range tests {
+		tok := decodeJWT(test.token)
+		if tok == nil {
+			t.Fatalf("Test %d: unable to decode %s\n", i, test.token)
+		}
+		if res := tok.verify(); res != test.expected {
+			t.Errorf("Test %d: expected %v, got %v\n", i, test.expected, res)
+		}
+	}
+
+	// Tampered claims
+	tok := decodeJWT(tests[0].token)
+	tok.signed += "x"
+	if tok.verify() {
+		t.Errorf("Expected tampered token not to verify\n")
+	}
+
+	req, _ := requestFromURI("http://example.com/")
+	req.Header.Set("Authorization", "Bearer "+tests[0].token)
+	checkGetters(t, &httpsource.RequestResponsePair{Request: req}, []getterTest{
+		{"request.jwt.verified", []string{"true"}},
+	})
+
+	for _, bad := range []string{`{"keys":[]}`, `{"keys":[{"kty":"XYZ"}]}`, `{"keys":[{"kty":"EC","crv":"P-192"}]}`, `{"keys":[{"kty":"RSA","n":"!!"}]}`} {
+		if _, err := parseJWKS([]byte(bad)); err == nil {
+			t.Errorf("Expected an error parsing %s\n", bad)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Named lists of values, set by LoadLists.
+var namedLists = make(map[string][]string)
+
+// LoadLists loads named lists of values, such as IP prefixes, from files with
+// one value per line.  Blank lines and lines starting with # are ignored.
+// Rules refer to a list as @name in their Value or Values.
+func LoadLists(files map[string]string) error {
+	for name, fname := range files {
+		vals, err := readListFile(fname)
+		if err != nil {
+			return fmt.Errorf("Unable to load list %s: %v", name, err)
+		}
+		namedLists[name] = vals
+	}
+	return nil
+}
+
+func readListFile(fname string) ([]string, error) {
+	fp, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var vals []string
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vals = append(vals, line)
+	}
+	return vals, scanner.Err()
+}
+
+// ruleValues returns the values of a list operator: Values, or Value if it
+// is the only one, with any @name references replaced by the named list.
+func ruleValues(r *Rule) ([]string, error) {
+	vals := r.Values
+	if len(vals) == 0 && r.Value != "" {
+		vals = []string{r.Value}
+	}
+	var out []string
+	for _, v := range vals {
+		if !strings.HasPrefix(v, "@") {
+			out = append(out, v)
+			continue
+		}
+		list, ok := namedLists[v[1:]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown list: %s", v[1:])
+		}
+		out = append(out, list...)
+	}
+	return out, nil
+}
@@ -0,0 +1,137 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"golang.org/x/net/html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A trailing ::attr(name) selects an attribute rather than the text.
+var cssAttrSuffix = regexp.MustCompile(`::attr\(([^)]+)\)$`)
+
+// htmlDocument is a parsed body, or the error from parsing it.
+type htmlDocument struct {
+	doc *html.Node
+	err error
+}
+
+// xmlDocument is a parsed body, or the error from parsing it.
+type xmlDocument struct {
+	doc *xmlquery.Node
+	err error
+}
+
+func pairBody(pair *httpsource.RequestResponsePair, rr string) []byte {
+	if rr == "response" {
+		return pair.ResponseBody
+	}
+	return pair.RequestBody
+}
+
+// getHTMLBody parses the request or response body once per pair.
+func getHTMLBody(pair *httpsource.RequestResponsePair, rr string) (*html.Node, error) {
+	d := pair.Memoize("html."+rr, func() interface{} {
+		doc, err := html.Parse(bytes.NewReader(pairBody(pair, rr)))
+		return &htmlDocument{doc, err}
+	}).(*htmlDocument)
+	return d.doc, d.err
+}
+
+// getXMLBody parses the request or response body once per pair.
+func getXMLBody(pair *httpsource.RequestResponsePair, rr string) (*xmlquery.Node, error) {
+	d := pair.Memoize("xml."+rr, func() interface{} {
+		doc, err := xmlquery.Parse(bytes.NewReader(pairBody(pair, rr)))
+		if err != nil {
+			err = fmt.Errorf("Body is not XML: %v", err)
+		}
+		return &xmlDocument{doc, err}
+	}).(*xmlDocument)
+	return d.doc, d.err
+}
+
+// Text content of an HTML node and its descendants.
+func htmlText(n *html.Node) string {
+	var buf strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.TrimSpace(buf.String())
+}
+
+// Build a getter for request.html.<selector> and response.html.<selector>.
+// The selector is a CSS selector, optionally followed by ::attr(name), with
+// a value for every match.
+func buildHTMLGetter(rr, selector string) (FieldGetter, error) {
+	attr := ""
+	if m := cssAttrSuffix.FindStringSubmatch(selector); m != nil {
+		attr = strings.TrimSpace(m[1])
+		selector = selector[:len(selector)-len(m[0])]
+	}
+	sel, err := cascadia.Compile(selector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid selector %s: %v", selector, err)
+	}
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		doc, err := getHTMLBody(pair, rr)
+		if err != nil {
+			return nil, err
+		}
+		var vals []string
+		for _, n := range sel.MatchAll(doc) {
+			if attr == "" {
+				vals = append(vals, htmlText(n))
+				continue
+			}
+			for _, a := range n.Attr {
+				if a.Key == attr {
+					vals = append(vals, a.Val)
+				}
+			}
+		}
+		return vals, nil
+	}, nil
+}
+
+// Build a getter for request.xml.<xpath> and response.xml.<xpath>.
+// Elements and attributes match their text content, and expressions such as
+// count() their result.
+func buildXPathGetter(rr, path string) (FieldGetter, error) {
+	expr, err := xpath.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid XPath %s: %v", path, err)
+	}
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		doc, err := getXMLBody(pair, rr)
+		if err != nil {
+			return nil, err
+		}
+		var vals []string
+		switch v := expr.Evaluate(xmlquery.CreateXPathNavigator(doc)).(type) {
+		case *xpath.NodeIterator:
+			for v.MoveNext() {
+				vals = append(vals, strings.TrimSpace(v.Current().Value()))
+			}
+		case float64:
+			vals = append(vals, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			vals = append(vals, strconv.FormatBool(v))
+		case string:
+			vals = append(vals, v)
+		}
+		return vals, nil
+	}, nil
+}
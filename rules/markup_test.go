@@ -0,0 +1,45 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"testing"
+)
+
+func TestHTMLGetter(t *testing.T) {
+	body := `<html><body>
+		<form class="login" action="/session" method="post"><input name="user"></form>
+		<ul><li>one</li><li>two <b>2</b></li></ul>
+		</body></html>`
+	pair := &httpsource.RequestResponsePair{ResponseBody: []byte(body)}
+	checkGetters(t, pair, []getterTest{
+		{"response.html.form.login::attr(action)", []string{"/session"}},
+		{"response.html.form input::attr(name)", []string{"user"}},
+		{"response.html.li", []string{"one", "two 2"}},
+		{"response.html.table", nil},
+	})
+	if _, err := buildGetter("response.html.[["); err == nil {
+		t.Errorf("Expected an error for an invalid selector.\n")
+	}
+}
+
+func TestXPathGetter(t *testing.T) {
+	body := `<?xml version="1.0"?>
+		<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+		<soap:Body><m:GetUser xmlns:m="urn:users" id="7"><m:Name>bob</m:Name></m:GetUser></soap:Body>
+		</soap:Envelope>`
+	pair := &httpsource.RequestResponsePair{RequestBody: []byte(body), ResponseBody: []byte("<unclosed")}
+	checkGetters(t, pair, []getterTest{
+		{"request.xml.local-name(//soap:Body/*[1])", []string{"GetUser"}},
+		{"request.xml.//m:GetUser/@id", []string{"7"}},
+		{"request.xml.//m:Name", []string{"bob"}},
+		{"request.xml.count(//m:Name)", []string{"1"}},
+		{"request.xml.//missing", nil},
+	})
+	if _, err := buildGetter("request.xml.//["); err == nil {
+		t.Errorf("Expected an error for an invalid XPath.\n")
+	}
+	g, _ := buildGetter("response.xml.//a")
+	if _, err := g(pair); err == nil {
+		t.Errorf("Expected an error for a non-XML body.\n")
+	}
+}
@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"sort"
+	"strings"
+)
+
+// Severities a Rule may have, from lowest to highest.
+var severities = []string{"info", "low", "medium", "high", "critical"}
+
+// Match is a pair matched by one or more rules.  Values holds, for each
+// field tested, the values that caused the match, and Metadata any details
+// reported by the operators, such as the patterns found by contains-any.
+// Severity is the highest of the matching rules, and Tags the union of their
+// tags.
+type Match struct {
+	Pair     *httpsource.RequestResponsePair
+	Rules    []string
+	Severity string
+	Tags     []string
+	Values   map[string][]string
+	Metadata map[string][]string
+}
+
+// severityRank orders severities, with an unset severity lowest.
+func severityRank(severity string) int {
+	for i, s := range severities {
+		if s == severity {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func validSeverity(severity string) error {
+	if severity != "" && severityRank(severity) == 0 {
+		return fmt.Errorf("Invalid severity %s, must be one of %s", severity, strings.Join(severities, ", "))
+	}
+	return nil
+}
+
+// NewMatch records that the rule matched the pair.  The rule must have been
+// compiled.
+func NewMatch(r *Rule, pair *httpsource.RequestResponsePair) *Match {
+	m := &Match{
+		Pair:     pair,
+		Rules:    []string{r.Name},
+		Severity: r.Severity,
+		Tags:     append([]string(nil), r.Tags...),
+		Values:   make(map[string][]string),
+		Metadata: make(map[string][]string),
+	}
+	collectTriggers(r.evaluator, pair, m)
+	return m
+}
+
+// Merge adds the rules, tags and values of another match of the same pair.
+func (m *Match) Merge(other *Match) {
+	m.Rules = appendUnique(m.Rules, other.Rules...)
+	m.Tags = appendUnique(m.Tags, other.Tags...)
+	if severityRank(other.Severity) > severityRank(m.Severity) {
+		m.Severity = other.Severity
+	}
+	for field, vals := range other.Values {
+		m.Values[field] = appendUnique(m.Values[field], vals...)
+	}
+	for key, vals := range other.Metadata {
+		m.Metadata[key] = appendUnique(m.Metadata[key], vals...)
+	}
+}
+
+// HasTag returns true if any of the matching rules has the tag.
+func (m *Match) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields returns the fields in Values in sorted order.
+func (m *Match) Fields() []string {
+	fields := make([]string, 0, len(m.Values))
+	for f := range m.Values {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func appendUnique(list []string, vals ...string) []string {
+	for _, v := range vals {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// metadataReporter is implemented by evaluators that report details of a
+// match beyond the field values.
+type metadataReporter interface {
+	metadata(pair *httpsource.RequestResponsePair) map[string][]string
+}
+
+// collectTriggers adds the values of each field that caused the evaluator to
+// match, and any metadata.  Negated rules have no triggering values.
+func collectTriggers(ev Evaluator, pair *httpsource.RequestResponsePair, m *Match) {
+	var subRules []Rule
+	switch e := ev.(type) {
+	case *AndEvaluator:
+		subRules = e.rule.Rules
+	case *OrEvaluator:
+		subRules = e.rule.Rules
+	case *SequenceEvaluator:
+		// Only the last step matched this pair
+		subRules = e.rule.Rules[len(e.rule.Rules)-1:]
+	case valueTester:
+		if vals := matchingValues(e, pair); len(vals) > 0 {
+			field := e.base().rule.Field
+			m.Values[field] = appendUnique(m.Values[field], vals...)
+		}
+	}
+	if r, ok := ev.(metadataReporter); ok {
+		for key, vals := range r.metadata(pair) {
+			if len(vals) > 0 {
+				m.Metadata[key] = appendUnique(m.Metadata[key], vals...)
+			}
+		}
+	}
+	for i := range subRules {
+		if subRules[i].Eval(pair) {
+			collectTriggers(subRules[i].evaluator, pair, m)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"net/http"
+	"testing"
+)
+
+func TestNewMatch(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/login?user=admin", nil)
+	req.Header.Add("X-Forwarded-For", "10.0.0.1, 192.0.2.1, 10.0.0.2")
+	pair := &httpsource.RequestResponsePair{Request: req, Response: &http.Response{StatusCode: 200}}
+	r := Rule{
+		Name:     "internal-login",
+		Severity: "high",
+		Tags:     []string{"auth"},
+		Expr: `request.method in [POST, PUT] and request.header.x-forwarded-for startswith "10."
+			and (request.query.user == "root" or request.query.user == "admin")
+			and not response.code == 401`,
+	}
+	if err := r.Compile(); err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+	if !r.Eval(pair) {
+		t.Fatalf("Expected the rule to match.\n")
+	}
+	m := NewMatch(&r, pair)
+	if m.Pair != pair || !equalValues(m.Rules, []string{"internal-login"}) || m.Severity != "high" || !m.HasTag("auth") {
+		t.Errorf("Unexpected match: %+v\n", m)
+	}
+	expected := map[string][]string{
+		"request.method":                 {"POST"},
+		"request.header.x-forwarded-for": {"10.0.0.1", "10.0.0.2"},
+		"request.query.user":             {"admin"},
+	}
+	if fields := m.Fields(); !equalValues(fields, []string{"request.header.x-forwarded-for", "request.method", "request.query.user"}) {
+		t.Errorf("Unexpected fields %v\n", fields)
+	}
+	for field, vals := range expected {
+		if !equalValues(m.Values[field], vals) {
+			t.Errorf("%s: expected %q, got %q\n", field, vals, m.Values[field])
+		}
+	}
+}
+
+func TestMatchMerge(t *testing.T) {
+	pair := &httpsource.RequestResponsePair{}
+	a := &Match{Pair: pair, Rules: []string{"a"}, Severity: "low", Tags: []string{"x"},
+		Values: map[string][]string{"request.method": {"GET"}}}
+	b := &Match{Pair: pair, Rules: []string{"b"}, Severity: "critical", Tags: []string{"x", "y"},
+		Values: map[string][]string{"request.method": {"GET"}, "request.url": {"/"}}}
+	a.Merge(b)
+	if !equalValues(a.Rules, []string{"a", "b"}) || a.Severity != "critical" || !equalValues(a.Tags, []string{"x", "y"}) {
+		t.Errorf("Unexpected merge: %+v\n", a)
+	}
+	if !equalValues(a.Values["request.method"], []string{"GET"}) || !equalValues(a.Values["request.url"], []string{"/"}) {
+		t.Errorf("Unexpected merged values: %v\n", a.Values)
+	}
+	a.Merge(&Match{Pair: pair, Severity: "info"})
+	if a.Severity != "critical" {
+		t.Errorf("Expected severity to stay critical, got %s\n", a.Severity)
+	}
+}
+
+func TestInvalidSeverity(t *testing.T) {
+	r := Rule{Name: "bad", Severity: "severe", Operator: "==", Field: "request.method", Value: "GET"}
+	if err := r.Compile(); err == nil {
+		t.Errorf("Expected an error for an invalid severity.\n")
+	}
+}
@@ -0,0 +1,183 @@
+package rules
+
+import (
+	"math/big"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Detectors for personal data.  Candidates are validated before they are
+// reported (card numbers by the Luhn check and issuer, IBANs by their
+// checksum, SSNs by the area, group and serial rules), and only masked
+// samples are kept.
+
+// Fields that may carry personal data
+var piiFields = []string{"request.url.query", "request.headers", "request.body", "response.headers", "response.body"}
+
+var (
+	cardPattern  = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	ibanPattern  = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`)
+	ssnPattern   = regexp.MustCompile(`\b(\d{3})-(\d{2})-(\d{4})\b`)
+	emailPattern = regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b`)
+)
+
+// unescapePII decodes a urlencoded value, such as a query string, so that
+// candidates written with escapes are found too.
+func unescapePII(val string) string {
+	if !strings.ContainsRune(val, '%') {
+		return val
+	}
+	if u, err := url.QueryUnescape(val); err == nil {
+		return u
+	}
+	return val
+}
+
+func digitsOnly(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+// luhnValid returns true if the digits pass the Luhn check.
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// cardIssuer returns true if the number has the prefix and length of a
+// major card network.
+func cardIssuer(digits string) bool {
+	n := len(digits)
+	prefix := func(lo, hi string) bool {
+		p := digits[:len(lo)]
+		return p >= lo && p <= hi
+	}
+	switch {
+	case digits[0] == '4':
+		return n == 13 || n == 16 || n == 19
+	case prefix("51", "55"), prefix("2221", "2720"):
+		return n == 16
+	case prefix("34", "34"), prefix("37", "37"):
+		return n == 15
+	case prefix("6011", "6011"), prefix("65", "65"), prefix("644", "649"):
+		return n >= 16
+	case prefix("3528", "3589"):
+		return n >= 16
+	case prefix("300", "305"), prefix("36", "36"), prefix("38", "39"):
+		return n >= 14
+	}
+	return false
+}
+
+// Evidence of a card number is its last four digits.
+func findCreditCards(val string) []string {
+	var found []string
+	for _, m := range cardPattern.FindAllString(unescapePII(val), -1) {
+		digits := digitsOnly(m)
+		if len(digits) < 13 || len(digits) > 19 || !cardIssuer(digits) || !luhnValid(digits) {
+			continue
+		}
+		found = appendUnique(found, strings.Repeat("*", len(digits)-4)+digits[len(digits)-4:])
+	}
+	return found
+}
+
+// ibanValid checks the length and mod 97 checksum of an IBAN.
+func ibanValid(iban string) bool {
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	var buf strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			buf.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			buf.WriteString(strconv.Itoa(int(c-'A') + 10))
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(buf.String(), 10)
+	return ok && n.Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// Evidence of an IBAN is its country and last four characters.
+func findIBANs(val string) []string {
+	var found []string
+	for _, m := range ibanPattern.FindAllString(unescapePII(val), -1) {
+		iban := strings.Replace(m, " ", "", -1)
+		if !ibanValid(iban) {
+			continue
+		}
+		found = appendUnique(found, iban[:2]+strings.Repeat("*", len(iban)-6)+iban[len(iban)-4:])
+	}
+	return found
+}
+
+// ssnValid applies the rules for issued SSNs: no area 000, 666 or 900-999,
+// no group 00 and no serial 0000, excluding numbers known from advertising.
+func ssnValid(area, group, serial string) bool {
+	if area == "000" || area == "666" || area >= "900" || group == "00" || serial == "0000" {
+		return false
+	}
+	switch area + group + serial {
+	case "078051120", "219099999", "123456789":
+		return false
+	}
+	return true
+}
+
+// Evidence of an SSN is its last four digits.
+func findSSNs(val string) []string {
+	var found []string
+	for _, m := range ssnPattern.FindAllStringSubmatch(unescapePII(val), -1) {
+		if ssnValid(m[1], m[2], m[3]) {
+			found = appendUnique(found, "***-**-"+m[3])
+		}
+	}
+	return found
+}
+
+// Evidence of an email address is its first character and domain.
+func findEmails(val string) []string {
+	var found []string
+	for _, m := range emailPattern.FindAllString(unescapePII(val), -1) {
+		at := strings.LastIndexByte(m, '@')
+		local := m[:at]
+		if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+			continue
+		}
+		found = appendUnique(found, local[:1]+"***"+m[at:])
+	}
+	return found
+}
+
+func init() {
+	for _, d := range []*detector{
+		{name: "pii.credit-card", severity: "high", fields: piiFields, find: findCreditCards},
+		{name: "pii.iban", severity: "medium", fields: piiFields, find: findIBANs},
+		{name: "pii.ssn", severity: "high", fields: piiFields, find: findSSNs},
+		{name: "pii.email", severity: "low", fields: piiFields, find: findEmails},
+	} {
+		registerDetector(d)
+	}
+}
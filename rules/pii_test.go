@@ -0,0 +1,66 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"net/http"
+	"testing"
+)
+
+func TestPIIDetectors(t *testing.T) {
+	tests := []struct {
+		detector, value string
+		expected        []string
+	}{
+		{"pii.credit-card", "card=4111 1111 1111 1111&exp=12/30", []string{"************1111"}},
+		{"pii.credit-card", `{"pan": "5500-0000-0000-0004", "amex": "378282246310005"}`, []string{"************0004", "***********0005"}},
+		{"pii.credit-card", "card=4111111111111112", nil},
+		{"pii.credit-card", "order=1234567812345670", nil},
+		{"pii.credit-card", "id=41111111111111110000000", nil},
+		{"pii.iban", "iban=DE89 3704 0044 0532 0130 00", []string{"DE****************3000"}},
+		{"pii.iban", "GB82WEST12345698765432", []string{"GB****************5432"}},
+		{"pii.iban", "GB82WEST12345698765433", nil},
+		{"pii.ssn", "ssn=123-45-6780", []string{"***-**-6780"}},
+		{"pii.ssn", "000-12-3456 666-12-3456 912-12-3456 123-00-4567 123-45-0000 078-05-1120", nil},
+		{"pii.ssn", "tel 555-123-4567", nil},
+		{"pii.email", "to=john.doe%40example.com&cc=x", []string{"j***@example.com"}},
+		{"pii.email", "From: Jane <jane@mail.example.org>\r\n", []string{"j***@mail.example.org"}},
+		{"pii.email", "user@localhost .bad.@example.com", nil},
+	}
+	for _, test := range tests {
+		found := detectors[test.detector].find(test.value)
+		if len(found) != len(test.expected) || (len(found) > 0 && !equalValues(found, test.expected)) {
+			t.Errorf("%s %q: expected %v, got %v\n", test.detector, test.value, test.expected, found)
+		}
+	}
+}
+
+func TestPIIMatch(t *testing.T) {
+	rules, err := DetectorRules([]string{"pii.*", "!pii.email"})
+	if err != nil || len(rules) != 3 {
+		t.Fatalf("Unable to build rules: %v %v\n", rules, err)
+	}
+	card := rules[0]
+	if card.Name != "pii.credit-card" || !equalValues(card.Tags, []string{"pii"}) {
+		t.Fatalf("Unexpected rule %s %v\n", card.Name, card.Tags)
+	}
+	if err := CompileRules(rules); err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+
+	body := `4111111111111111 4012888888881881 5555555555554444 5105105105105100 378282246310005 6011111111111117`
+	req, _ := http.NewRequest("POST", "http://example.com/pay?card=4242424242424242", nil)
+	pair := &httpsource.RequestResponsePair{Request: req, RequestBody: []byte(body)}
+	if !card.Eval(pair) {
+		t.Fatalf("Expected a match.\n")
+	}
+	m := NewMatch(&card, pair)
+	if len(m.Metadata["pii.credit-card"]) != 6 {
+		t.Errorf("Expected 5 samples from the body and 1 from the query, got %v\n", m.Metadata["pii.credit-card"])
+	}
+	if !equalValues(m.Metadata["pii.credit-card.count"], []string{"request.url.query=1", "request.body=6"}) {
+		t.Errorf("Unexpected counts %v\n", m.Metadata["pii.credit-card.count"])
+	}
+	if len(m.Values) != 0 {
+		t.Errorf("Expected no values to be reported, got %v\n", m.Values)
+	}
+}
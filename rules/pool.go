@@ -0,0 +1,97 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"runtime"
+	"sync"
+)
+
+// PoolEngine is an alternative to RuleEngine that evaluates every rule
+// against a pair in a single pass, on a pool of workers.  As all of the
+// rules see the pair together, fields parsed by one rule (bodies, JSON,
+// cookies) are reused by the rest, and matches of the pair by several rules
+// are merged into one Match.
+type PoolEngine struct {
+	Matches    <-chan *Match
+	rules      []Rule
+	input      <-chan *httpsource.RequestResponsePair
+	workers    int
+	rawMatches chan *Match
+	lock       sync.Mutex
+	running    bool
+	allDone    chan bool
+}
+
+// NewPoolEngine creates a PoolEngine reading pairs from input, compiling
+// every rule first.  If workers is not positive, one is started per CPU.
+// Sequence rules are not supported.
+func NewPoolEngine(rules []Rule, input <-chan *httpsource.RequestResponsePair, workers int) (*PoolEngine, error) {
+	rules = append([]Rule(nil), rules...)
+	if err := CompileRules(rules); err != nil {
+		return nil, err
+	}
+	// Workers finish pairs out of order, which sequences cannot follow
+	for i := range rules {
+		if _, ok := rules[i].evaluator.(*SequenceEvaluator); ok {
+			return nil, fmt.Errorf("Sequence rule %s requires the rules engine", topLevelPath(&rules[i], i))
+		}
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	e := &PoolEngine{rules: rules, input: input, workers: workers}
+	e.rawMatches = make(chan *Match, 100)
+	e.Matches = makeDeduplicatingChannel(e.rawMatches)
+	e.allDone = make(chan bool)
+	return e, nil
+}
+
+// Start starts the workers, which stop once the input is closed.
+func (e *PoolEngine) Start() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.running {
+		return
+	}
+	e.running = true
+	var wg sync.WaitGroup
+	wg.Add(e.workers)
+	for i := 0; i < e.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for pair := range e.input {
+				if m := e.evalPair(pair); m != nil {
+					e.rawMatches <- m
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(e.rawMatches)
+		close(e.allDone)
+	}()
+}
+
+// evalPair returns the merged match of every rule matching the pair, or nil.
+func (e *PoolEngine) evalPair(pair *httpsource.RequestResponsePair) *Match {
+	var match *Match
+	for i := range e.rules {
+		if !e.rules[i].Eval(pair) {
+			continue
+		}
+		m := NewMatch(&e.rules[i], pair)
+		if match == nil {
+			match = m
+		} else {
+			match.Merge(m)
+		}
+	}
+	return match
+}
+
+// WaitUntilFinished waits until every pair has been evaluated.
+func (e *PoolEngine) WaitUntilFinished() {
+	<-e.allDone
+}
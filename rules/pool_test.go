@@ -0,0 +1,137 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPoolEngine(t *testing.T) {
+	pairs := make(chan *httpsource.RequestResponsePair, 3)
+	e, err := NewPoolEngine([]Rule{
+		{Name: "get", Severity: "low", Expr: `request.method == "GET"`},
+		{Name: "matir", Severity: "high", Tags: []string{"github"}, Expr: `request.url contains "Matir"`},
+		{Name: "post", Expr: `request.method == "POST"`},
+	}, pairs, 2)
+	if err != nil {
+		t.Fatalf("Unable to create engine: %v\n", err)
+	}
+	req, _ := http.NewRequest("GET", "https://github.com/Matir", nil)
+	pair := &httpsource.RequestResponsePair{Request: req}
+	other, _ := http.NewRequest("PUT", "https://example.com/", nil)
+	// The duplicate is dropped, and the PUT matches nothing
+	pairs <- pair
+	pairs <- pair
+	pairs <- &httpsource.RequestResponsePair{Request: other}
+	close(pairs)
+	e.Start()
+	var matches []*Match
+	for m := range e.Matches {
+		matches = append(matches, m)
+	}
+	e.WaitUntilFinished()
+	if len(matches) != 1 {
+		t.Fatalf("Expected 1 match, got %d\n", len(matches))
+	}
+	m := matches[0]
+	if !equalValues(m.Rules, []string{"get", "matir"}) || m.Severity != "high" || !m.HasTag("github") {
+		t.Errorf("Unexpected match: %+v\n", m)
+	}
+	if !equalValues(m.Values["request.method"], []string{"GET"}) || !equalValues(m.Values["request.url"], []string{"https://github.com/Matir"}) {
+		t.Errorf("Unexpected values: %v\n", m.Values)
+	}
+
+	if _, err := NewPoolEngine([]Rule{{Name: "bad", Expr: "request.method =="}}, pairs, 1); err == nil {
+		t.Errorf("Expected an error for an invalid rule.\n")
+	}
+	seq := Rule{Name: "seq", Operator: "sequence", Field: "client.ip", Value: "5m", Rules: []Rule{
+		{Expr: `request.method == "GET"`},
+		{Expr: `request.method == "POST"`},
+	}}
+	if _, err := NewPoolEngine([]Rule{seq}, pairs, 1); err == nil || !strings.Contains(err.Error(), "rules engine") {
+		t.Errorf("Expected an error for a sequence rule, got %v\n", err)
+	}
+}
+
+// benchmarkRules has a mix of header, URL and body rules, with several
+// rules parsing the same JSON body.
+func benchmarkRules(n int) []Rule {
+	var rules []Rule
+	for i := 0; i < n; i++ {
+		var expr string
+		switch i % 4 {
+		case 0:
+			expr = fmt.Sprintf(`request.url.path startswith "/api/v%d/"`, i)
+		case 1:
+			expr = fmt.Sprintf(`request.header.user-agent contains "scanner-%d"`, i)
+		case 2:
+			expr = fmt.Sprintf(`request.json.$.user.id == %d`, i)
+		case 3:
+			expr = fmt.Sprintf(`request.body ~= 'token-%d[a-f]+'`, i)
+		}
+		rules = append(rules, Rule{Name: fmt.Sprintf("rule-%d", i), Expr: expr})
+	}
+	return rules
+}
+
+func benchmarkPairs(n int) []*httpsource.RequestResponsePair {
+	pairs := make([]*httpsource.RequestResponsePair, n)
+	for i := range pairs {
+		body := fmt.Sprintf(`{"user": {"id": %d, "name": "%s"}, "token": "token-%dabc"}`, i%100, strings.Repeat("x", 512), i%100)
+		req, _ := http.NewRequest("POST", fmt.Sprintf("http://example.com/api/v%d/users", i%100), strings.NewReader(body))
+		req.Header.Set("User-Agent", fmt.Sprintf("scanner-%d", i%100))
+		req.Header.Set("Content-Type", "application/json")
+		pairs[i] = &httpsource.RequestResponsePair{Request: req, RequestBody: []byte(body)}
+	}
+	return pairs
+}
+
+func feedPairs(pairs []*httpsource.RequestResponsePair) <-chan *httpsource.RequestResponsePair {
+	c := make(chan *httpsource.RequestResponsePair, len(pairs))
+	for _, p := range pairs {
+		c <- p
+	}
+	close(c)
+	return c
+}
+
+// Discard the engines' logging while benchmarking
+func quietLogger(b *testing.B) {
+	saved := logger
+	SetLogger(log.New(ioutil.Discard, "", 0))
+	b.Cleanup(func() { SetLogger(saved) })
+}
+
+func BenchmarkRuleEngine(b *testing.B) {
+	quietLogger(b)
+	rules := benchmarkRules(100)
+	pairs := benchmarkPairs(b.N)
+	b.ResetTimer()
+	mux := httpsource.NewBlockingPairMux(feedPairs(pairs))
+	e, err := NewRuleEngine(rules, mux)
+	if err != nil {
+		b.Fatal(err)
+	}
+	e.Start()
+	go e.WaitUntilFinished()
+	for range e.Matches {
+	}
+}
+
+func BenchmarkPoolEngine(b *testing.B) {
+	quietLogger(b)
+	rules := benchmarkRules(100)
+	pairs := benchmarkPairs(b.N)
+	b.ResetTimer()
+	e, err := NewPoolEngine(rules, feedPairs(pairs), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	e.Start()
+	for range e.Matches {
+	}
+}
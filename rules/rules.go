@@ -1,28 +1,138 @@
 package rules
 
 import (
+	"errors"
+	"fmt"
 	"github.com/Matir/httpwatch/httpsource"
 	"log"
 	"os"
+	"strings"
 )
 
+// Rule is either a composite of Rules joined by an and/or Operator (or a
+// single negated rule), or a test of the values of Field against Value, or
+// Values for list operators such as in and in-cidr, which may refer to a
+// named list as @name.  Quantifier selects how many of the values must pass:
+// any (the default), all, none, or a count such as count>=2.  For the yara
+// operator, Value is the path of a YARA rule file, and for script, the path of
+// a Starlark file, optionally followed by :function.  Field may end with a
+// pipeline of transforms applied to each value, such as |urldecode|lower.
+//
+// A sequence rule matches pairs over time: Rules are its steps, Field the key
+// relating the pairs and Value the time window (see sequence.go).  Sequences
+// are only allowed as top-level rules, and only by the rules engine.
+//
+// Alternatively, Expr holds the whole rule as an expression (see ParseExpr).
+//
+// Severity (info, low, medium, high or critical) and Tags are copied to each
+// Match of a top-level rule.
 type Rule struct {
-	Name      string
-	Operator  string
-	Rules     []Rule
-	Field     string
-	Value     string
-	evaluator Evaluator
+	Name       string
+	Severity   string
+	Tags       []string
+	Expr       string
+	Operator   string
+	Rules      []Rule
+	Field      string
+	Value      string
+	Values     []string
+	Quantifier string
+	evaluator  Evaluator
 }
 
 var logger = log.New(os.Stderr, "rules: ", log.Lshortfile|log.Ltime)
 
+// RuleError is an error compiling one rule, identified by its path: the
+// name (or index) of the top-level rule, then the index of each sub-rule.
+type RuleError struct {
+	Path  string
+	Field string
+	Err   error
+}
+
+func (e *RuleError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Rule %s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("Rule %s (field %s): %v", e.Path, e.Field, e.Err)
+}
+
+// RuleErrors collects the errors from compiling several rules.
+type RuleErrors []*RuleError
+
+func (e RuleErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// CompileRules compiles each of the rules in place, returning a RuleErrors
+// with every problem found, or nil.
+func CompileRules(rules []Rule) error {
+	var errs RuleErrors
+	for i := range rules {
+		errs = append(errs, rules[i].compile(topLevelPath(&rules[i], i))...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func topLevelPath(r *Rule, i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("rules[%d]", i)
+}
+
+// Compile builds the evaluators for the rule and all of its sub-rules, so
+// that invalid fields, operators or values are found before any pair is
+// evaluated.
+func (r *Rule) Compile() error {
+	if errs := r.compile(topLevelPath(r, 0)); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r *Rule) compile(path string) RuleErrors {
+	if r.evaluator != nil {
+		return nil
+	}
+	var errs RuleErrors
+	if err := validSeverity(r.Severity); err != nil {
+		errs = append(errs, &RuleError{Path: path, Err: err})
+	}
+	for i := range r.Rules {
+		subPath := fmt.Sprintf("%s/rules[%d]", path, i)
+		// Sequences must see every pair, not only those reaching them
+		if r.Rules[i].Operator == "sequence" {
+			errs = append(errs, &RuleError{Path: subPath, Err: errors.New("Operator sequence is only allowed in a top-level rule")})
+			continue
+		}
+		errs = append(errs, r.Rules[i].compile(subPath)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	e, err := BuildEvaluator(r)
+	if err != nil {
+		return RuleErrors{{Path: path, Field: r.Field, Err: err}}
+	}
+	r.evaluator = e
+	return nil
+}
+
+// Eval returns true if the pair matches the rule.  Rules are normally
+// compiled first; one that fails to compile here never matches.
 func (r *Rule) Eval(pair *httpsource.RequestResponsePair) bool {
 	if r.evaluator == nil {
-		var err error
-		r.evaluator, err = BuildEvaluator(r)
-		if err != nil {
-			panic(err)
+		if err := r.Compile(); err != nil {
+			logger.Printf("%v\n", err)
+			return false
 		}
 	}
 	return r.evaluator.Eval(pair)
@@ -26,3 +26,91 @@ func TestRules(t *testing.T) {
 		t.Error("Expected request.url == url.\n")
 	}
 }
+
+func TestCompileRules(t *testing.T) {
+	rules := []Rule{
+		{Name: "ok", Operator: "==", Field: "request.method", Value: "GET"},
+		{Name: "admin", Operator: "and", Rules: []Rule{
+			{Operator: "==", Field: "request.method", Value: "POST"},
+			{Operator: "~=", Field: "request.url", Value: "("},
+		}},
+		{Operator: "==", Field: "request.methd", Value: "GET"},
+		{Name: "expr", Expr: `request.method ==`},
+	}
+	err := CompileRules(rules)
+	errs, ok := err.(RuleErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("Expected 3 errors, got %v\n", err)
+	}
+	expected := []struct{ path, field string }{
+		{"admin/rules[1]", "request.url"},
+		{"rules[2]", "request.methd"},
+		{"expr", ""},
+	}
+	for i, e := range expected {
+		if errs[i].Path != e.path || errs[i].Field != e.field {
+			t.Errorf("Error %d: expected %s (%s), got %v\n", i, e.path, e.field, errs[i])
+		}
+	}
+	if !strings.Contains(errs[0].Error(), "Rule admin/rules[1] (field request.url): ") {
+		t.Errorf("Unexpected message: %v\n", errs[0])
+	}
+	if rules[0].evaluator == nil || rules[1].Rules[0].evaluator == nil {
+		t.Errorf("Expected valid rules to be compiled.\n")
+	}
+	if rules[1].Eval(&httpsource.RequestResponsePair{}) {
+		t.Errorf("Expected a rule that fails to compile not to match.\n")
+	}
+	if err := CompileRules(rules[:1]); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
+
+func TestNewRuleEngineErrors(t *testing.T) {
+	mux := httpsource.NewBlockingPairMux(nil)
+	bad := []Rule{{Name: "bad", Operator: "??", Field: "request.method"}}
+	if _, err := NewRuleEngine(bad, mux); err == nil {
+		t.Errorf("Expected an error for an invalid rule.\n")
+	}
+	e, err := NewRuleEngine(nil, mux)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if err := e.AddRule(bad[0]); err == nil {
+		t.Errorf("Expected AddRule to fail for an invalid rule.\n")
+	}
+}
+
+func TestRuleEngineMatches(t *testing.T) {
+	pairs := make(chan *httpsource.RequestResponsePair, 2)
+	mux := httpsource.NewBlockingPairMux(pairs)
+	e, err := NewRuleEngine([]Rule{
+		{Name: "get", Severity: "low", Expr: `request.method == "GET"`},
+		{Name: "matir", Tags: []string{"github"}, Expr: `request.url contains "Matir"`},
+		{Name: "post", Expr: `request.method == "POST"`},
+	}, mux)
+	if err != nil {
+		t.Fatalf("Unable to create engine: %v\n", err)
+	}
+	req, _ := http.NewRequest("GET", "https://github.com/Matir", nil)
+	pair := &httpsource.RequestResponsePair{Request: req}
+	// The duplicate is dropped
+	pairs <- pair
+	pairs <- pair
+	close(pairs)
+	e.Start()
+	go e.WaitUntilFinished()
+	found := make(map[string]*Match)
+	for m := range e.Matches {
+		if _, ok := found[m.Rules[0]]; ok {
+			t.Errorf("Duplicate match for %s\n", m.Rules[0])
+		}
+		found[m.Rules[0]] = m
+	}
+	if len(found) != 2 || found["get"] == nil || found["matir"] == nil {
+		t.Fatalf("Expected matches for get and matir, got %v\n", found)
+	}
+	if found["get"].Severity != "low" || !found["matir"].HasTag("github") {
+		t.Errorf("Unexpected matches: %+v, %+v\n", found["get"], found["matir"])
+	}
+}
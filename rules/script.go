@@ -0,0 +1,321 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkjson"
+	"go.starlark.net/starlarkstruct"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scripts are Starlark files defining a function, match(pair) by default,
+// called for each pair.  The pair is read-only: request and response are
+// structs of the method, url, host, headers (a dict of lists), body, code and
+// status, and field(name) and get(name) return all or the first of the values
+// of any rule field, such as request.cookie.session|base64.  The json module
+// is available, but nothing can be loaded, and each call is limited in steps
+// and time.
+//
+// The match is decided by the truth of the result.  A dict result also adds
+// its entries, strings or lists of strings, to the metadata of the match
+// under script.<key>.
+
+// Limits on each call of a script, including the top level of the file
+const (
+	maxScriptSteps = 1000000
+	scriptTimeout  = 100 * time.Millisecond
+)
+
+// starlarkScript is a loaded script file, with the getters its calls have
+// built.
+type starlarkScript struct {
+	filename string
+	globals  starlark.StringDict
+	getters  map[string]FieldGetter
+	lock     sync.Mutex
+}
+
+var scriptFiles = struct {
+	sync.Mutex
+	m map[string]*starlarkScript
+}{m: make(map[string]*starlarkScript)}
+
+var scriptPredeclared = starlark.StringDict{
+	"json": starlarkjson.Module,
+}
+
+// loadScriptFile runs the top level of a script the first time it is used.
+func loadScriptFile(filename string) (*starlarkScript, error) {
+	scriptFiles.Lock()
+	defer scriptFiles.Unlock()
+	if s, ok := scriptFiles.m[filename]; ok {
+		return s, nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s, err := compileScript(filename, buf)
+	if err != nil {
+		return nil, err
+	}
+	scriptFiles.m[filename] = s
+	return s, nil
+}
+
+func compileScript(filename string, src []byte) (*starlarkScript, error) {
+	s := &starlarkScript{filename: filename, getters: make(map[string]FieldGetter)}
+	thread, stop := newScriptThread(filename)
+	defer stop()
+	globals, err := starlark.ExecFile(thread, filename, src, scriptPredeclared)
+	if err != nil {
+		return nil, err
+	}
+	s.globals = globals
+	return s, nil
+}
+
+// newScriptThread returns a thread with the limits applied, and a function
+// to call when it is done.
+func newScriptThread(name string) (*starlark.Thread, func()) {
+	thread := &starlark.Thread{
+		Name:  name,
+		Print: func(_ *starlark.Thread, msg string) { logger.Printf("%s: %s\n", name, msg) },
+	}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	timer := time.AfterFunc(scriptTimeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %v", scriptTimeout))
+	})
+	return thread, func() { timer.Stop() }
+}
+
+// function returns the named function of the script.
+func (s *starlarkScript) function(name string) (*starlark.Function, error) {
+	fn, ok := s.globals[name].(*starlark.Function)
+	if !ok {
+		return nil, fmt.Errorf("No function %s in %s", name, s.filename)
+	}
+	if fn.NumParams() != 1 {
+		return nil, fmt.Errorf("Function %s in %s must take one parameter", name, s.filename)
+	}
+	return fn, nil
+}
+
+// getter returns the getter for a field, building it the first time.
+func (s *starlarkScript) getter(field string) (FieldGetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if g, ok := s.getters[field]; ok {
+		return g, nil
+	}
+	g, err := buildGetter(field)
+	if err != nil {
+		return nil, err
+	}
+	s.getters[field] = g
+	return g, nil
+}
+
+// parseScriptValue splits a rule value into the file and function, as in
+// checks.star:admin_without_login.
+func parseScriptValue(value string) (string, string) {
+	if i := strings.LastIndexByte(value, ':'); i != -1 && isScriptIdent(value[i+1:]) {
+		return value[:i], value[i+1:]
+	}
+	return value, "match"
+}
+
+func isScriptIdent(s string) bool {
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ScriptEvaluator calls a script function with each pair.
+type ScriptEvaluator struct {
+	rule   *Rule
+	script *starlarkScript
+	fn     *starlark.Function
+}
+
+func buildScriptEvaluator(r *Rule) (*ScriptEvaluator, error) {
+	if r.Value == "" {
+		return nil, errors.New("Operator script requires a script file")
+	}
+	if r.Field != "" {
+		return nil, errors.New("Operator script does not take a field")
+	}
+	filename, name := parseScriptValue(r.Value)
+	s, err := loadScriptFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := s.function(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ScriptEvaluator{rule: r, script: s, fn: fn}, nil
+}
+
+func (e *ScriptEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	res := e.call(pair)
+	return res.err == nil && res.matched
+}
+
+// The entries of a dict result
+func (e *ScriptEvaluator) metadata(pair *httpsource.RequestResponsePair) map[string][]string {
+	return e.call(pair).metadata
+}
+
+// scriptResult is the outcome of calling a script with a pair.
+type scriptResult struct {
+	matched  bool
+	metadata map[string][]string
+	err      error
+}
+
+// call runs the function once per pair, logging any error.
+func (e *ScriptEvaluator) call(pair *httpsource.RequestResponsePair) *scriptResult {
+	key := fmt.Sprintf("script.%p", e.fn)
+	return pair.Memoize(key, func() interface{} {
+		thread, stop := newScriptThread(e.script.filename)
+		defer stop()
+		v, err := starlark.Call(thread, e.fn, starlark.Tuple{e.pairValue(pair)}, nil)
+		if err != nil {
+			logger.Printf("Script %s: %v\n", e.rule.Value, err)
+			return &scriptResult{err: err}
+		}
+		res := &scriptResult{matched: bool(v.Truth())}
+		if d, ok := v.(*starlark.Dict); ok {
+			res.metadata = scriptMetadata(d)
+		}
+		return res
+	}).(*scriptResult)
+}
+
+func scriptMetadata(d *starlark.Dict) map[string][]string {
+	md := make(map[string][]string, d.Len())
+	for _, item := range d.Items() {
+		key := "script." + scriptString(item[0])
+		if list, ok := item[1].(starlark.Indexable); ok && item[1].Type() != "string" {
+			for i := 0; i < list.Len(); i++ {
+				md[key] = append(md[key], scriptString(list.Index(i)))
+			}
+		} else {
+			md[key] = []string{scriptString(item[1])}
+		}
+	}
+	return md
+}
+
+// Strings are used as they are, rather than quoted
+func scriptString(v starlark.Value) string {
+	if s, ok := starlark.AsString(v); ok {
+		return s
+	}
+	return v.String()
+}
+
+// pairValue is the read-only view of a pair passed to scripts.
+func (e *ScriptEvaluator) pairValue(pair *httpsource.RequestResponsePair) starlark.Value {
+	values := func(name string) ([]string, error) {
+		g, err := e.script.getter(name)
+		if err != nil {
+			return nil, err
+		}
+		return g(pair)
+	}
+	field := starlark.NewBuiltin("field", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+			return nil, err
+		}
+		vals, err := values(name)
+		if err != nil {
+			return nil, err
+		}
+		return scriptList(vals), nil
+	})
+	get := starlark.NewBuiltin("get", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		var def starlark.Value = starlark.None
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name, &def); err != nil {
+			return nil, err
+		}
+		vals, err := values(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) == 0 {
+			return def, nil
+		}
+		return starlark.String(vals[0]), nil
+	})
+
+	var request, response starlark.Value = starlark.None, starlark.None
+	if req := pair.Request; req != nil {
+		url := ""
+		if req.URL != nil {
+			url = req.URL.String()
+		}
+		request = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"method":  starlark.String(req.Method),
+			"url":     starlark.String(url),
+			"host":    starlark.String(req.Host),
+			"headers": scriptHeaders(req.Header),
+			"body":    starlark.String(pair.RequestBody),
+		})
+	}
+	if resp := pair.Response; resp != nil {
+		response = starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"code":    starlark.MakeInt(resp.StatusCode),
+			"status":  starlark.String(resp.Status),
+			"headers": scriptHeaders(resp.Header),
+			"body":    starlark.String(pair.ResponseBody),
+		})
+	}
+	v := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"request":  request,
+		"response": response,
+		"field":    field,
+		"get":      get,
+	})
+	v.Freeze()
+	return v
+}
+
+func scriptList(vals []string) *starlark.List {
+	elems := make([]starlark.Value, len(vals))
+	for i, v := range vals {
+		elems[i] = starlark.String(v)
+	}
+	return starlark.NewList(elems)
+}
+
+// Headers by canonical name, in sorted order
+func scriptHeaders(h http.Header) *starlark.Dict {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d := starlark.NewDict(len(names))
+	for _, name := range names {
+		d.SetKey(starlark.String(name), scriptList(h[name]))
+	}
+	return d
+}
@@ -0,0 +1,104 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testScript = `
+SUSPICIOUS = ["X-Original-Url", "X-Rewrite-Url"]
+
+def match(pair):
+    found = [name for name in pair.request.headers if name in SUSPICIOUS]
+    if not found:
+        return False
+    return {"headers": found, "count": len(found)}
+
+def big_body(pair):
+    limit = 2 * len(pair.field("request.header.x-expected")[0])
+    return pair.response != None and len(pair.response.body) > limit
+
+def admin_cookie(pair):
+    return pair.get("request.cookie.role|base64", "") == "admin" and pair.response.code == 200
+
+def spin(pair):
+    n = 0
+    for i in range(100000000):
+        n += i
+    return n > 0
+
+def unknown_field(pair):
+    return pair.get("request.nope")
+
+def mutate(pair):
+    pair.request.headers["X-Evil"] = ["1"]
+    return True
+
+def two(a, b):
+    return True
+`
+
+func TestScriptRules(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "checks.star")
+	if err := ioutil.WriteFile(filename, []byte(testScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Original-Url", "/admin")
+	req.Header.Set("X-Expected", "abc")
+	req.Header.Set("Cookie", "role=YWRtaW4=")
+	resp := &http.Response{StatusCode: 200, Header: make(http.Header)}
+	pair := &httpsource.RequestResponsePair{Request: req, Response: resp, ResponseBody: []byte("0123456789")}
+
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{filename, true},
+		{filename + ":big_body", true},
+		{filename + ":admin_cookie", true},
+		{filename + ":spin", false},
+		{filename + ":unknown_field", false},
+		{filename + ":mutate", false},
+	}
+	for _, test := range tests {
+		r := Rule{Name: test.value, Operator: "script", Value: test.value}
+		if err := r.Compile(); err != nil {
+			t.Fatalf("%s: unable to compile: %v\n", test.value, err)
+		}
+		if res := r.Eval(pair); res != test.expected {
+			t.Errorf("%s: expected %v, got %v\n", test.value, test.expected, res)
+		}
+	}
+
+	r := Rule{Operator: "script", Value: filename}
+	r.Compile()
+	m := NewMatch(&r, pair)
+	if !equalValues(m.Metadata["script.headers"], []string{"X-Original-Url"}) || !equalValues(m.Metadata["script.count"], []string{"1"}) {
+		t.Errorf("Unexpected metadata %v\n", m.Metadata)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.star")
+	ioutil.WriteFile(bad, []byte("load('x.star', 'y')\n"), 0644)
+	errTests := []struct {
+		rule Rule
+		msg  string
+	}{
+		{Rule{Operator: "script"}, "requires a script file"},
+		{Rule{Operator: "script", Value: filename, Field: "request.body"}, "does not take a field"},
+		{Rule{Operator: "script", Value: filename + ":missing"}, "No function missing"},
+		{Rule{Operator: "script", Value: filename + ":SUSPICIOUS"}, "No function SUSPICIOUS"},
+		{Rule{Operator: "script", Value: filename + ":two"}, "must take one parameter"},
+		{Rule{Operator: "script", Value: bad}, "load not implemented"},
+	}
+	for _, test := range errTests {
+		if err := test.rule.Compile(); err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%s: expected %q, got %v\n", test.rule.Value, test.msg, err)
+		}
+	}
+}
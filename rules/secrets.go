@@ -0,0 +1,202 @@
+package rules
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Detectors for credentials and keys in cleartext traffic.  Token formats
+// are checked for entropy, so that documentation examples and placeholders
+// are not reported.
+
+// Fields that may carry a token anywhere
+var secretFields = []string{"request.url", "request.headers", "request.body", "response.headers", "response.body"}
+
+// patternSecret finds tokens matching re, whose first group (or whole match)
+// is the secret, with at least minEntropy bits per byte.
+func patternSecret(re *regexp.Regexp, minEntropy float64) func(string) []string {
+	return func(val string) []string {
+		var found []string
+		for _, m := range re.FindAllStringSubmatch(val, -1) {
+			secret := m[0]
+			if len(m) > 1 {
+				secret = m[1]
+			}
+			if shannonEntropy(secret) >= minEntropy {
+				found = appendUnique(found, redact(secret))
+			}
+		}
+		return found
+	}
+}
+
+var (
+	basicAuthPattern    = regexp.MustCompile(`(?i)^basic\s+([A-Za-z0-9+/=_-]+)\s*$`)
+	bearerTokenPattern  = regexp.MustCompile(`(?i)^bearer\s+(\S{16,})\s*$`)
+	privateKeyPattern   = regexp.MustCompile(`-----BEGIN ((?:RSA |EC |DSA |OPENSSH |ENCRYPTED |PGP )?PRIVATE KEY(?: BLOCK)?)-----`)
+	jsonPasswordPattern = regexp.MustCompile(`"([^"]*)"\s*:\s*"([^"]+)"`)
+)
+
+// Evidence of Basic credentials is the user name; the password is hidden.
+func findBasicAuth(val string) []string {
+	m := basicAuthPattern.FindStringSubmatch(val)
+	if m == nil {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		if decoded, err = base64.RawStdEncoding.DecodeString(m[1]); err != nil {
+			return nil
+		}
+	}
+	user, password, ok := splitCredentials(string(decoded))
+	if !ok || password == "" {
+		return nil
+	}
+	return []string{user + ":****"}
+}
+
+func splitCredentials(s string) (string, string, bool) {
+	i := strings.IndexByte(s, ':')
+	if i == -1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+func findBearerToken(val string) []string {
+	m := bearerTokenPattern.FindStringSubmatch(val)
+	if m == nil || shannonEntropy(m[1]) < 3.0 {
+		return nil
+	}
+	return []string{"Bearer " + redact(m[1])}
+}
+
+// Evidence of a private key is its header line.
+func findPrivateKey(val string) []string {
+	var found []string
+	for _, m := range privateKeyPattern.FindAllStringSubmatch(val, -1) {
+		found = appendUnique(found, "-----BEGIN "+m[1]+"-----")
+	}
+	return found
+}
+
+// isPasswordField returns true for field names such as password,
+// new_passwd or user[pwd].
+func isPasswordField(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"password", "passwd", "passphrase", "pwd"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}) {
+		if word == "pass" {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds non-empty password fields in urlencoded forms, query strings and
+// JSON objects.  The evidence is the name of the field.
+func findPasswordField(val string) []string {
+	var found []string
+	if strings.HasPrefix(strings.TrimSpace(val), "{") {
+		for _, m := range jsonPasswordPattern.FindAllStringSubmatch(val, -1) {
+			if isPasswordField(m[1]) {
+				found = appendUnique(found, m[1]+"=****")
+			}
+		}
+		return found
+	}
+	val = strings.TrimPrefix(val, "?")
+	if i := strings.IndexByte(val, '?'); i != -1 {
+		val = val[i+1:]
+	}
+	for _, kv := range strings.Split(val, "&") {
+		i := strings.IndexByte(kv, '=')
+		if i == -1 || i == len(kv)-1 {
+			continue
+		}
+		name := kv[:i]
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if isPasswordField(name) {
+			found = appendUnique(found, name+"=****")
+		}
+	}
+	return found
+}
+
+func init() {
+	for _, d := range []*detector{
+		{
+			name:     "secret.basic-auth",
+			severity: "high",
+			fields:   []string{"request.header.authorization", "request.header.proxy-authorization"},
+			find:     findBasicAuth,
+		},
+		{
+			name:     "secret.bearer-token",
+			severity: "medium",
+			fields:   []string{"request.header.authorization", "request.header.proxy-authorization"},
+			find:     findBearerToken,
+		},
+		{
+			name:     "secret.aws-access-key",
+			severity: "high",
+			fields:   secretFields,
+			find:     patternSecret(regexp.MustCompile(`\b((?:AKIA|ASIA|AGPA|AIDA|AROA)[0-9A-Z]{16})\b`), 3.0),
+		},
+		{
+			name:     "secret.aws-secret-key",
+			severity: "critical",
+			fields:   secretFields,
+			find:     patternSecret(regexp.MustCompile(`(?i)aws.{0,20}?(?:secret|private).{0,20}?[\s"'=:]+([A-Za-z0-9/+]{40})\b`), 4.0),
+		},
+		{
+			name:     "secret.gcp-api-key",
+			severity: "high",
+			fields:   secretFields,
+			find:     patternSecret(regexp.MustCompile(`\b(AIza[0-9A-Za-z_-]{35})`), 3.5),
+		},
+		{
+			name:     "secret.github-token",
+			severity: "high",
+			fields:   secretFields,
+			find:     patternSecret(regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{82})\b`), 3.5),
+		},
+		{
+			name:     "secret.slack-token",
+			severity: "high",
+			fields:   secretFields,
+			find:     patternSecret(regexp.MustCompile(`\b(xox[abeoprs]-[0-9A-Za-z-]{10,})\b`), 3.0),
+		},
+		{
+			name:     "secret.slack-webhook",
+			severity: "medium",
+			fields:   secretFields,
+			find:     patternSecret(regexp.MustCompile(`https://hooks\.slack\.com/services/(T[A-Z0-9]+/B[A-Z0-9]+/[A-Za-z0-9]{16,})`), 3.0),
+		},
+		{
+			name:     "secret.private-key",
+			severity: "critical",
+			fields:   []string{"request.body", "response.body"},
+			find:     findPrivateKey,
+		},
+		{
+			name:     "secret.password-field",
+			severity: "medium",
+			fields:   []string{"request.url.query", "request.body"},
+			find:     findPasswordField,
+		},
+	} {
+		registerDetector(d)
+	}
+}
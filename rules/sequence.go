@@ -0,0 +1,268 @@
+package rules
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"sync"
+	"time"
+)
+
+// Sequence rules match when pairs sharing a key, the first value of Field
+// (such as client.ip or request.cookie.session), match each of the steps in
+// Rules in order, all within the window in Value (such as 5m).  The match is
+// reported for the pair completing the sequence.
+//
+// A negated step is satisfied by the absence of any pair matching the rule it
+// negates: between the steps around it, or for a leading negated step, within
+// the window before the first step.  For example, not a login followed by a
+// request for /admin matches admin requests without a prior login.
+//
+// A pair matching the first step while a sequence is in progress starts it
+// again, so the window is measured from the latest start.  Pairs are taken in
+// the order they complete, which may differ slightly from the order of their
+// requests; a pair whose request precedes one already seen for its key counts
+// as at the time of that one.  Only the rules engine evaluates pairs in a
+// single order, so sequences are not supported by the pool engine.
+//
+// State is kept only for keys of pairs matching some step, negated or not,
+// and for a limited number of keys, dropping the least recently seen.
+
+// State is kept for at most this many keys per rule
+const maxSequenceKeys = 10000
+
+// sequenceStep is a step of a sequence, or if absent, a rule that must not
+// match.
+type sequenceStep struct {
+	rule   *Rule
+	absent bool
+}
+
+// SequenceEvaluator tracks the progress of each key through the steps.
+type SequenceEvaluator struct {
+	rule   *Rule
+	key    FieldGetter
+	window time.Duration
+	steps  []sequenceStep
+	first  int
+	lock   sync.Mutex
+	states map[string]*list.Element
+	recent *list.List
+}
+
+// sequenceState is the progress of a key: the next step to match, and the
+// requests that matched the earlier steps.
+type sequenceState struct {
+	key      string
+	next     int
+	start    time.Time
+	latest   time.Time
+	requests []string
+	lastSeen []time.Time
+}
+
+// sequenceResult is the outcome of a pair, and if it completed a sequence,
+// its key, start and requests.
+type sequenceResult struct {
+	matched  bool
+	key      string
+	start    time.Time
+	requests []string
+}
+
+func buildSequenceEvaluator(r *Rule) (*SequenceEvaluator, error) {
+	if r.Field == "" {
+		return nil, errors.New("Operator sequence requires a key field")
+	}
+	key, err := buildGetter(r.Field)
+	if err != nil {
+		return nil, err
+	}
+	window, err := time.ParseDuration(r.Value)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("Operator sequence requires a time window, such as 5m, not %q", r.Value)
+	}
+	if len(r.Rules) < 2 {
+		return nil, fmt.Errorf("Operator sequence requires at least two steps, got %d", len(r.Rules))
+	}
+	e := &SequenceEvaluator{
+		rule:   r,
+		key:    key,
+		window: window,
+		first:  -1,
+		states: make(map[string]*list.Element),
+		recent: list.New(),
+	}
+	for i := range r.Rules {
+		step := &r.Rules[i]
+		if err := step.Compile(); err != nil {
+			return nil, err
+		}
+		if n, ok := step.evaluator.(*NotEvaluator); ok {
+			e.steps = append(e.steps, sequenceStep{rule: &n.rule.Rules[0], absent: true})
+			continue
+		}
+		if e.first == -1 {
+			e.first = i
+		}
+		e.steps = append(e.steps, sequenceStep{rule: step})
+	}
+	if e.first == -1 {
+		return nil, errors.New("Operator sequence requires a step that is not negated")
+	}
+	if e.steps[len(e.steps)-1].absent {
+		return nil, errors.New("The last step of a sequence cannot be negated")
+	}
+	return e, nil
+}
+
+func (e *SequenceEvaluator) Eval(pair *httpsource.RequestResponsePair) bool {
+	return e.advance(pair).matched
+}
+
+// The key, the time of the first step, and the requests matching each step
+func (e *SequenceEvaluator) metadata(pair *httpsource.RequestResponsePair) map[string][]string {
+	res := e.advance(pair)
+	if !res.matched {
+		return nil
+	}
+	return map[string][]string{
+		"sequence.key":      {res.key},
+		"sequence.start":    {res.start.Format(time.RFC3339Nano)},
+		"sequence.requests": res.requests,
+	}
+}
+
+// advance updates the state of the key of the pair once per pair, so that
+// repeated evaluations of the pair give the same result.
+func (e *SequenceEvaluator) advance(pair *httpsource.RequestResponsePair) *sequenceResult {
+	return pair.Memoize(fmt.Sprintf("sequence.%p", e), func() interface{} {
+		keys, err := e.key(pair)
+		if err != nil || len(keys) == 0 || keys[0] == "" {
+			return &sequenceResult{}
+		}
+		// The steps themselves have no state
+		matches := make([]bool, len(e.steps))
+		matchesAny := false
+		for i, s := range e.steps {
+			matches[i] = s.rule.Eval(pair)
+			matchesAny = matchesAny || matches[i]
+		}
+		if !matchesAny {
+			return &sequenceResult{}
+		}
+		now := pair.RequestTime
+		if now.IsZero() {
+			now = time.Now()
+		}
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		return e.update(e.state(keys[0]), matches, now, pairSummary(pair))
+	}).(*sequenceResult)
+}
+
+// state returns the state of a key, creating it if needed.
+func (e *SequenceEvaluator) state(key string) *sequenceState {
+	if elem, ok := e.states[key]; ok {
+		e.recent.MoveToFront(elem)
+		return elem.Value.(*sequenceState)
+	}
+	st := &sequenceState{key: key, next: e.first, lastSeen: make([]time.Time, len(e.steps))}
+	e.states[key] = e.recent.PushFront(st)
+	if e.recent.Len() > maxSequenceKeys {
+		oldest := e.recent.Back()
+		e.recent.Remove(oldest)
+		delete(e.states, oldest.Value.(*sequenceState).key)
+	}
+	return st
+}
+
+// guards returns the negated steps immediately before step i.
+func (e *SequenceEvaluator) guards(i int) []int {
+	var guards []int
+	for j := i - 1; j >= 0 && e.steps[j].absent; j-- {
+		guards = append(guards, j)
+	}
+	return guards
+}
+
+// nextStep returns the step after i that is not negated.
+func (e *SequenceEvaluator) nextStep(i int) int {
+	for i++; i < len(e.steps) && e.steps[i].absent; i++ {
+	}
+	return i
+}
+
+// canStart returns true if no pair has matched a leading negated step
+// within the window.
+func (e *SequenceEvaluator) canStart(st *sequenceState, now time.Time) bool {
+	for _, g := range e.guards(e.first) {
+		if !st.lastSeen[g].IsZero() && now.Sub(st.lastSeen[g]) <= e.window {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *SequenceEvaluator) update(st *sequenceState, matches []bool, now time.Time, summary string) *sequenceResult {
+	if now.Before(st.latest) {
+		now = st.latest
+	}
+	st.latest = now
+	started := st.next != e.first
+	if started && now.Sub(st.start) > e.window {
+		st.reset(e.first)
+		started = false
+	}
+	for i, s := range e.steps {
+		if s.absent && matches[i] {
+			st.lastSeen[i] = now
+		}
+	}
+	if started {
+		for _, g := range e.guards(st.next) {
+			if matches[g] {
+				st.reset(e.first)
+				started = false
+				break
+			}
+		}
+	}
+
+	step := -1
+	switch {
+	case matches[st.next] && (started || e.canStart(st, now)):
+		step = st.next
+	case started && matches[e.first] && e.canStart(st, now):
+		st.reset(e.first)
+		step = e.first
+	}
+	if step == -1 {
+		return &sequenceResult{}
+	}
+	if step == e.first {
+		st.start = now
+	}
+	st.requests = append(st.requests, fmt.Sprintf("%d: %s", step+1, summary))
+	st.next = e.nextStep(step)
+	if st.next < len(e.steps) {
+		return &sequenceResult{}
+	}
+	res := &sequenceResult{matched: true, key: st.key, start: st.start, requests: st.requests}
+	st.reset(e.first)
+	return res
+}
+
+func (st *sequenceState) reset(first int) {
+	st.next = first
+	st.requests = nil
+}
+
+// pairSummary describes the request of a pair, as METHOD url.
+func pairSummary(pair *httpsource.RequestResponsePair) string {
+	if pair.Request == nil || pair.Request.URL == nil {
+		return ""
+	}
+	return pair.Request.Method + " " + pair.Request.URL.String()
+}
@@ -0,0 +1,170 @@
+package rules
+
+import (
+	"container/list"
+	"github.com/Matir/httpwatch/httpsource"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seqPair makes a pair from client at the given offset in seconds.
+func seqPair(method, path string, code int, client string, offset int) *httpsource.RequestResponsePair {
+	req, _ := http.NewRequest(method, "http://example.com"+path, nil)
+	return &httpsource.RequestResponsePair{
+		Request:     req,
+		Response:    &http.Response{StatusCode: code, Header: make(http.Header)},
+		ClientAddr:  &net.TCPAddr{IP: net.ParseIP(client), Port: 40000},
+		RequestTime: time.Unix(1700000000+int64(offset), 0),
+	}
+}
+
+func TestSequenceRules(t *testing.T) {
+	failedLogin := Rule{Expr: `request.url.path == "/login" and response.code == 401`}
+	login := Rule{Expr: `request.url.path == "/login" and response.code == 302`}
+	admin := Rule{Expr: `request.url.path startswith "/admin"`}
+	newRule := func(window string, steps ...Rule) *Rule {
+		r := &Rule{Name: "seq", Operator: "sequence", Field: "client.ip", Value: window, Rules: steps}
+		if err := r.Compile(); err != nil {
+			t.Fatalf("Unable to compile: %v\n", err)
+		}
+		return r
+	}
+	type event struct {
+		method, path string
+		code         int
+		client       string
+		offset       int
+		expected     bool
+	}
+	tests := []struct {
+		name   string
+		rule   *Rule
+		events []event
+	}{
+		{"failed then successful login", newRule("5m", failedLogin, login), []event{
+			{"POST", "/login", 401, "192.0.2.1", 0, false},
+			{"POST", "/login", 302, "192.0.2.2", 10, false},
+			{"GET", "/", 200, "192.0.2.1", 20, false},
+			{"POST", "/login", 302, "192.0.2.1", 30, true},
+			{"POST", "/login", 302, "192.0.2.1", 40, false},
+			// Outside the window
+			{"POST", "/login", 401, "192.0.2.1", 100, false},
+			{"POST", "/login", 302, "192.0.2.1", 500, false},
+			// The window runs from the latest failure
+			{"POST", "/login", 401, "192.0.2.1", 600, false},
+			{"POST", "/login", 401, "192.0.2.1", 800, false},
+			{"POST", "/login", 302, "192.0.2.1", 1000, true},
+		}},
+		{"admin without login", newRule("30m", Rule{Operator: "not", Rules: []Rule{login}}, admin), []event{
+			{"GET", "/admin/users", 200, "192.0.2.1", 0, true},
+			{"POST", "/login", 302, "192.0.2.2", 10, false},
+			{"GET", "/admin/users", 200, "192.0.2.2", 20, false},
+			{"GET", "/admin/users", 200, "192.0.2.2", 3600, true},
+		}},
+		{"out of order", newRule("5m", failedLogin, login), []event{
+			{"POST", "/login", 401, "192.0.2.1", 100, false},
+			// Counted as at 100
+			{"POST", "/login", 302, "192.0.2.1", 50, true},
+			{"POST", "/login", 401, "192.0.2.1", 1000, false},
+			{"POST", "/login", 401, "192.0.2.1", 500, false},
+			// The window still runs from 1000
+			{"POST", "/login", 302, "192.0.2.1", 1400, false},
+		}},
+		{"broken by a negated step", newRule("5m", failedLogin, Rule{Expr: `not request.url.path == "/logout"`}, login), []event{
+			{"POST", "/login", 401, "192.0.2.1", 0, false},
+			{"GET", "/logout", 200, "192.0.2.1", 10, false},
+			{"POST", "/login", 302, "192.0.2.1", 20, false},
+			{"POST", "/login", 401, "192.0.2.1", 30, false},
+			{"POST", "/login", 302, "192.0.2.1", 40, true},
+		}},
+	}
+	for _, test := range tests {
+		for i, ev := range test.events {
+			pair := seqPair(ev.method, ev.path, ev.code, ev.client, ev.offset)
+			if res := test.rule.Eval(pair); res != ev.expected {
+				t.Errorf("%s, event %d: expected %v, got %v\n", test.name, i, ev.expected, res)
+			}
+			// Evaluating the pair again has no further effect
+			if res := test.rule.Eval(pair); res != ev.expected {
+				t.Errorf("%s, event %d: expected %v again, got %v\n", test.name, i, ev.expected, res)
+			}
+		}
+	}
+
+	r := newRule("5m", failedLogin, login)
+	r.Eval(seqPair("POST", "/login", 401, "192.0.2.1", 0))
+	pair := seqPair("POST", "/login", 302, "192.0.2.1", 30)
+	if !r.Eval(pair) {
+		t.Fatalf("Expected a match.\n")
+	}
+	m := NewMatch(r, pair)
+	if !equalValues(m.Metadata["sequence.key"], []string{"192.0.2.1"}) ||
+		!equalValues(m.Metadata["sequence.requests"], []string{"1: POST http://example.com/login", "2: POST http://example.com/login"}) ||
+		!equalValues(m.Metadata["sequence.start"], []string{time.Unix(1700000000, 0).Format(time.RFC3339Nano)}) {
+		t.Errorf("Unexpected metadata %v\n", m.Metadata)
+	}
+	if !equalValues(m.Values["response.code"], []string{"302"}) {
+		t.Errorf("Expected the values of the last step, got %v\n", m.Values)
+	}
+}
+
+func TestSequenceState(t *testing.T) {
+	r := &Rule{Operator: "sequence", Field: "client.ip", Value: "24h", Rules: []Rule{
+		{Expr: `request.method == "GET"`},
+		{Expr: `request.method == "POST"`},
+	}}
+	if err := r.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	e := r.evaluator.(*SequenceEvaluator)
+	for i := 0; i <= maxSequenceKeys; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String()
+		r.Eval(seqPair("GET", "/", 200, ip, i))
+	}
+	if len(e.states) != maxSequenceKeys || e.recent.Len() != maxSequenceKeys {
+		t.Errorf("Expected %d keys, got %d\n", maxSequenceKeys, len(e.states))
+	}
+	// The oldest key was dropped, and starting it again drops the next
+	if r.Eval(seqPair("POST", "/", 200, "10.0.0.0", maxSequenceKeys+1)) {
+		t.Errorf("Expected the first key to be dropped\n")
+	}
+	if !r.Eval(seqPair("POST", "/", 200, "10.0.0.2", maxSequenceKeys+1)) {
+		t.Errorf("Expected the third key to be kept\n")
+	}
+	// Pairs matching no step leave no state
+	e.states = make(map[string]*list.Element)
+	e.recent.Init()
+	r.Eval(seqPair("PUT", "/", 200, "10.1.0.1", 0))
+	if len(e.states) != 0 || e.recent.Len() != 0 {
+		t.Errorf("Expected no state, got %d keys\n", len(e.states))
+	}
+	r.Eval(seqPair("POST", "/", 200, "10.1.0.1", 0))
+	if len(e.states) != 1 {
+		t.Errorf("Expected 1 key, got %d\n", len(e.states))
+	}
+
+	step := Rule{Expr: `request.method == "GET"`}
+	seq := Rule{Operator: "sequence", Field: "client.ip", Value: "5m", Rules: []Rule{step, step}}
+	errTests := []struct {
+		rule Rule
+		msg  string
+	}{
+		{Rule{Operator: "sequence", Value: "5m", Rules: []Rule{step, step}}, "requires a key field"},
+		{Rule{Operator: "sequence", Field: "client.ip", Rules: []Rule{step, step}}, "requires a time window"},
+		{Rule{Operator: "sequence", Field: "client.ip", Value: "-1s", Rules: []Rule{step, step}}, "requires a time window"},
+		{Rule{Operator: "sequence", Field: "client.ip", Value: "5m", Rules: []Rule{step}}, "at least two steps"},
+		{Rule{Operator: "sequence", Field: "client.ip", Value: "5m", Rules: []Rule{{Expr: "not " + step.Expr}, {Expr: "not " + step.Expr}}}, "not negated"},
+		{Rule{Operator: "sequence", Field: "client.ip", Value: "5m", Rules: []Rule{step, {Expr: "not " + step.Expr}}}, "last step"},
+		{Rule{Operator: "and", Rules: []Rule{step, seq}}, "only allowed in a top-level rule"},
+		{Rule{Operator: "not", Rules: []Rule{{Operator: "or", Rules: []Rule{seq}}}}, "only allowed in a top-level rule"},
+		{Rule{Operator: "sequence", Field: "client.ip", Value: "5m", Rules: []Rule{step, seq}}, "only allowed in a top-level rule"},
+	}
+	for _, test := range errTests {
+		if err := test.rule.Compile(); err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Expected %q, got %v\n", test.msg, err)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Sigma rules for the webserver and proxy log sources are converted to Rule
+// trees.  The fields of those log sources are mapped to getters (see
+// sigmaFields), and fields already written as getters, such as
+// request.body, are used as they are.  Values are matched without regard to
+// case, with * and ? wildcards, as in Sigma; the contains, startswith,
+// endswith, all, re (with i, m and s), cidr, gt, gte, lt and lte modifiers
+// are supported.  Conditions may use and, or, not, parentheses, and 1 of,
+// any of or all of a pattern or them; aggregations are not supported.  The
+// title becomes the name, the level the severity, and the tags are kept.
+
+// SigmaError is a Sigma rule that could not be converted, either because it
+// uses features with no equivalent here or is invalid.
+type SigmaError struct {
+	File        string
+	Index       int
+	Title       string
+	Unsupported []string
+	Err         error
+}
+
+func (e *SigmaError) Error() string {
+	loc := fmt.Sprintf("%s[%d]", e.File, e.Index)
+	if e.Title != "" {
+		loc = fmt.Sprintf("%s (%s)", e.File, e.Title)
+	}
+	if len(e.Unsupported) > 0 {
+		return fmt.Sprintf("%s: Unsupported features: %s", loc, strings.Join(e.Unsupported, ", "))
+	}
+	return fmt.Sprintf("%s: %v", loc, e.Err)
+}
+
+// SigmaErrors collects the rules of a file that could not be converted.
+type SigmaErrors []*SigmaError
+
+func (e SigmaErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Fields of the webserver and proxy log sources, by their getters.  Sizes
+// are of the bodies, as the headers are not counted.
+var sigmaFields = map[string]string{
+	"cs-method":       "request.method",
+	"c-uri":           "request.url",
+	"cs-uri":          "request.url",
+	"c-uri-stem":      "request.url.path",
+	"cs-uri-stem":     "request.url.path",
+	"c-uri-query":     "request.url.query",
+	"cs-uri-query":    "request.url.query",
+	"cs-host":         "request.host",
+	"cs-user-agent":   "request.header.user-agent",
+	"c-useragent":     "request.header.user-agent",
+	"cs-referrer":     "request.header.referer",
+	"cs-referer":      "request.header.referer",
+	"cs-cookie":       "request.header.cookie",
+	"cs-content-type": "request.header.content-type",
+	"sc-content-type": "response.header.content-type",
+	"cs-bytes":        "request.bodysize",
+	"sc-bytes":        "response.bodysize",
+	"sc-status":       "response.code",
+	"c-ip":            "client.ip",
+	"src_ip":          "client.ip",
+	"s-ip":            "server.ip",
+	"dst_ip":          "server.ip",
+	"dst_port":        "server.port",
+	"s-port":          "server.port",
+}
+
+var sigmaLevels = map[string]string{
+	"informational": "info",
+	"low":           "low",
+	"medium":        "medium",
+	"high":          "high",
+	"critical":      "critical",
+}
+
+type sigmaRule struct {
+	Title     string
+	ID        string
+	Level     string
+	Tags      []string
+	Action    string
+	Logsource struct {
+		Category string
+		Product  string
+		Service  string
+	}
+	Detection map[string]interface{}
+}
+
+// LoadSigmaFile converts the rules in a Sigma YAML file.  See
+// ParseSigmaRules.
+func LoadSigmaFile(filename string) ([]Rule, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSigmaRules(filename, buf)
+}
+
+// ParseSigmaRules converts the Sigma rules in each document of a YAML file.
+// Rules that cannot be converted are skipped, and returned as SigmaErrors
+// along with the rest.
+func ParseSigmaRules(filename string, src []byte) ([]Rule, error) {
+	var rules []Rule
+	var errs SigmaErrors
+	dec := yaml.NewDecoder(bytes.NewReader(src))
+	for i := 0; ; i++ {
+		var sr sigmaRule
+		if err := dec.Decode(&sr); err == io.EOF {
+			break
+		} else if err != nil {
+			// The decoder cannot continue after a syntax error
+			errs = append(errs, &SigmaError{File: filename, Index: i, Err: err})
+			break
+		}
+		r, err := convertSigmaRule(&sr)
+		if err != nil {
+			err.File, err.Index, err.Title = filename, i, sr.Title
+			errs = append(errs, err)
+			continue
+		}
+		rules = append(rules, *r)
+	}
+	if len(errs) > 0 {
+		return rules, errs
+	}
+	return rules, nil
+}
+
+type sigmaConverter struct {
+	searches    map[string]Rule
+	unsupported []string
+}
+
+func (c *sigmaConverter) unsupportedFeature(f string) {
+	c.unsupported = appendUnique(c.unsupported, f)
+}
+
+func convertSigmaRule(sr *sigmaRule) (*Rule, *SigmaError) {
+	c := &sigmaConverter{searches: make(map[string]Rule)}
+	if sr.Action != "" {
+		c.unsupportedFeature("action " + sr.Action)
+	}
+	switch sr.Logsource.Category {
+	case "", "webserver", "proxy":
+	default:
+		c.unsupportedFeature("log source " + sr.Logsource.Category)
+	}
+	r := &Rule{Name: sr.Title, Tags: append([]string{"sigma"}, sr.Tags...)}
+	if r.Name == "" {
+		r.Name = sr.ID
+	}
+	if sr.Level != "" {
+		severity, ok := sigmaLevels[sr.Level]
+		if !ok {
+			return nil, &SigmaError{Err: fmt.Errorf("Invalid level: %s", sr.Level)}
+		}
+		r.Severity = severity
+	}
+
+	condition, ok := sr.Detection["condition"]
+	if !ok {
+		return nil, &SigmaError{Err: errors.New("No condition in detection")}
+	}
+	names := make([]string, 0, len(sr.Detection))
+	for name := range sr.Detection {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch name {
+		case "condition":
+			continue
+		case "timeframe":
+			c.unsupportedFeature("timeframe")
+			continue
+		}
+		s, err := c.convertSearch(sr.Detection[name])
+		if err != nil {
+			return nil, &SigmaError{Err: fmt.Errorf("%s: %v", name, err)}
+		}
+		c.searches[name] = s
+	}
+
+	var conditions []string
+	switch v := condition.(type) {
+	case string:
+		conditions = []string{v}
+	case []interface{}:
+		for _, cond := range v {
+			conditions = append(conditions, fmt.Sprint(cond))
+		}
+	default:
+		return nil, &SigmaError{Err: fmt.Errorf("Invalid condition: %v", condition)}
+	}
+	var rules []Rule
+	for _, cond := range conditions {
+		cr, err := c.convertCondition(cond)
+		if err != nil {
+			return nil, &SigmaError{Err: err}
+		}
+		rules = append(rules, cr)
+	}
+	if len(c.unsupported) > 0 {
+		return nil, &SigmaError{Unsupported: c.unsupported}
+	}
+	cond := combineRules("or", rules)
+	r.Operator, r.Field, r.Value, r.Values, r.Quantifier, r.Rules = cond.Operator, cond.Field, cond.Value, cond.Values, cond.Quantifier, cond.Rules
+	return r, nil
+}
+
+// combineRules joins the rules with an and or or, unless there is only one.
+func combineRules(op string, rules []Rule) Rule {
+	if len(rules) == 1 {
+		return rules[0]
+	}
+	return Rule{Operator: op, Rules: rules}
+}
+
+// convertSearch converts a search identifier: a map of fields, all of which
+// must match, or a list of maps, any of which must.
+func (c *sigmaConverter) convertSearch(search interface{}) (Rule, error) {
+	switch s := search.(type) {
+	case map[string]interface{}:
+		fields := make([]string, 0, len(s))
+		for f := range s {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		var rules []Rule
+		for _, f := range fields {
+			fr, err := c.convertField(f, s[f])
+			if err != nil {
+				return Rule{}, err
+			}
+			rules = append(rules, fr)
+		}
+		if len(rules) == 0 {
+			return Rule{}, errors.New("Empty search")
+		}
+		return combineRules("and", rules), nil
+	case []interface{}:
+		var rules []Rule
+		for _, elem := range s {
+			if _, ok := elem.(map[string]interface{}); !ok {
+				c.unsupportedFeature("keyword searches")
+				return Rule{}, nil
+			}
+			er, err := c.convertSearch(elem)
+			if err != nil {
+				return Rule{}, err
+			}
+			rules = append(rules, er)
+		}
+		if len(rules) == 0 {
+			return Rule{}, errors.New("Empty search")
+		}
+		return combineRules("or", rules), nil
+	}
+	return Rule{}, fmt.Errorf("Invalid search: %v", search)
+}
+
+// convertField converts a field|modifiers: values test.  Any of the values
+// may match, or with the all modifier, every one must.
+func (c *sigmaConverter) convertField(key string, value interface{}) (Rule, error) {
+	parts := strings.Split(key, "|")
+	field, ok := sigmaFields[strings.ToLower(parts[0])]
+	if !ok {
+		if !strings.ContainsRune(parts[0], '.') {
+			c.unsupportedFeature("field " + parts[0])
+			return Rule{}, nil
+		}
+		field = parts[0]
+	}
+
+	match, all, reFlags := "", false, ""
+	for _, mod := range parts[1:] {
+		switch mod {
+		case "contains", "startswith", "endswith", "re", "cidr", "gt", "gte", "lt", "lte":
+			if match != "" {
+				c.unsupportedFeature("modifiers " + match + "|" + mod)
+			}
+			match = mod
+		case "all":
+			all = true
+		case "i", "m", "s":
+			if match != "re" {
+				return Rule{}, fmt.Errorf("Modifier %s must follow re", mod)
+			}
+			reFlags += mod
+		default:
+			c.unsupportedFeature("modifier " + mod)
+		}
+	}
+
+	var values []string
+	switch v := value.(type) {
+	case nil:
+		// The field is absent or empty
+		return Rule{Operator: "glob", Field: field, Value: "?*", Quantifier: "none"}, nil
+	case []interface{}:
+		for _, elem := range v {
+			if _, ok := elem.(map[string]interface{}); ok {
+				return Rule{}, fmt.Errorf("Invalid value for %s", key)
+			}
+			values = append(values, fmt.Sprint(elem))
+		}
+	case map[string]interface{}:
+		return Rule{}, fmt.Errorf("Invalid value for %s", key)
+	default:
+		values = []string{fmt.Sprint(v)}
+	}
+	if len(values) == 0 {
+		return Rule{}, fmt.Errorf("No values for %s", key)
+	}
+
+	join := "or"
+	if all {
+		join = "and"
+	}
+	var rules []Rule
+	switch match {
+	case "cidr":
+		if !all {
+			return Rule{Operator: "in-cidr", Field: field, Values: values}, nil
+		}
+		for _, v := range values {
+			rules = append(rules, Rule{Operator: "in-cidr", Field: field, Value: v})
+		}
+	case "re":
+		if reFlags != "" {
+			reFlags = "(?" + reFlags + ")"
+		}
+		for _, v := range values {
+			rules = append(rules, Rule{Operator: "~=", Field: field, Value: reFlags + v})
+		}
+	case "gt", "gte", "lt", "lte":
+		op := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}[match]
+		for _, v := range values {
+			rules = append(rules, Rule{Operator: op, Field: field, Value: v})
+		}
+	default:
+		// Without all, plain values are tested together, as a set for
+		// equality, or with one automaton for contains.
+		var set, plain []string
+		for _, v := range values {
+			if hasSigmaWildcard(v) {
+				pattern := sigmaGlob(v)
+				switch match {
+				case "contains":
+					pattern = "*" + pattern + "*"
+				case "startswith":
+					pattern += "*"
+				case "endswith":
+					pattern = "*" + pattern
+				}
+				rules = append(rules, Rule{Operator: "glob-i", Field: field, Value: pattern})
+				continue
+			}
+			v = unescapeSigma(v)
+			switch {
+			case match == "" && !all:
+				set = append(set, v)
+			case match == "contains" && !all:
+				plain = append(plain, v)
+			case match == "":
+				rules = append(rules, Rule{Operator: "in-i", Field: field, Value: v})
+			default:
+				rules = append(rules, Rule{Operator: match + "-i", Field: field, Value: v})
+			}
+		}
+		if len(set) > 0 {
+			rules = append(rules, Rule{Operator: "in-i", Field: field, Values: set})
+		}
+		if len(plain) > 0 {
+			rules = append(rules, Rule{Operator: "contains-any-i", Field: field, Values: plain})
+		}
+	}
+	return combineRules(join, rules), nil
+}
+
+// hasSigmaWildcard returns true if the value has an unescaped * or ?.
+func hasSigmaWildcard(v string) bool {
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			if i+1 < len(v) && strings.IndexByte(`*?\`, v[i+1]) != -1 {
+				i++
+			}
+		case '*', '?':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeSigma removes the escapes from \*, \? and \\; other backslashes
+// are literal.
+func unescapeSigma(v string) string {
+	var buf strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) && strings.IndexByte(`*?\`, v[i+1]) != -1 {
+			i++
+		}
+		buf.WriteByte(v[i])
+	}
+	return buf.String()
+}
+
+// sigmaGlob converts a value with wildcards to a glob, escaping the
+// characters special only to globs.
+func sigmaGlob(v string) string {
+	var buf strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case c == '\\' && i+1 < len(v) && strings.IndexByte(`*?\`, v[i+1]) != -1:
+			buf.WriteString(v[i : i+2])
+			i++
+		case c == '\\' || c == '[':
+			buf.WriteString(`\` + string(c))
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+var sigmaConditionToken = regexp.MustCompile(`\(|\)|[^\s()]+`)
+
+type sigmaConditionParser struct {
+	c    *sigmaConverter
+	toks []string
+	i    int
+}
+
+func (p *sigmaConditionParser) peek() string {
+	if p.i < len(p.toks) {
+		return p.toks[p.i]
+	}
+	return ""
+}
+
+func (p *sigmaConditionParser) next() string {
+	tok := p.peek()
+	if p.i < len(p.toks) {
+		p.i++
+	}
+	return tok
+}
+
+// convertCondition converts a condition to a Rule of the searches.
+func (c *sigmaConverter) convertCondition(cond string) (Rule, error) {
+	if strings.ContainsRune(cond, '|') {
+		c.unsupportedFeature("aggregations")
+		return Rule{}, nil
+	}
+	p := &sigmaConditionParser{c: c, toks: sigmaConditionToken.FindAllString(cond, -1)}
+	r, err := p.parseOr()
+	if err != nil {
+		return Rule{}, err
+	}
+	if tok := p.peek(); tok != "" {
+		return Rule{}, fmt.Errorf("Unexpected %s in condition: %s", tok, cond)
+	}
+	return r, nil
+}
+
+func (p *sigmaConditionParser) parseChain(op string, operand func() (Rule, error)) (Rule, error) {
+	first, err := operand()
+	if err != nil {
+		return Rule{}, err
+	}
+	rules := []Rule{first}
+	for strings.ToLower(p.peek()) == op {
+		p.next()
+		r, err := operand()
+		if err != nil {
+			return Rule{}, err
+		}
+		rules = append(rules, r)
+	}
+	return combineRules(op, rules), nil
+}
+
+func (p *sigmaConditionParser) parseOr() (Rule, error) {
+	return p.parseChain("or", p.parseAnd)
+}
+
+func (p *sigmaConditionParser) parseAnd() (Rule, error) {
+	return p.parseChain("and", p.parseNot)
+}
+
+func (p *sigmaConditionParser) parseNot() (Rule, error) {
+	tok := p.next()
+	switch strings.ToLower(tok) {
+	case "not":
+		r, err := p.parseNot()
+		if err != nil {
+			return Rule{}, err
+		}
+		return Rule{Operator: "not", Rules: []Rule{r}}, nil
+	case "(":
+		r, err := p.parseOr()
+		if err != nil {
+			return Rule{}, err
+		}
+		if tok := p.next(); tok != ")" {
+			return Rule{}, fmt.Errorf("Expected ) in condition, got %q", tok)
+		}
+		return r, nil
+	case "1", "any", "all":
+		if strings.ToLower(p.peek()) != "of" {
+			break
+		}
+		p.next()
+		op := "or"
+		if strings.ToLower(tok) == "all" {
+			op = "and"
+		}
+		return p.parseOf(op, p.next())
+	case "", ")", "and", "or", "of":
+		return Rule{}, fmt.Errorf("Unexpected %q in condition", tok)
+	case "near":
+		p.c.unsupportedFeature("near")
+		return Rule{}, nil
+	}
+	r, ok := p.c.searches[tok]
+	if !ok {
+		return Rule{}, fmt.Errorf("Unknown search %s in condition", tok)
+	}
+	return r, nil
+}
+
+// parseOf joins the searches matching a pattern, or them.
+func (p *sigmaConditionParser) parseOf(op, pattern string) (Rule, error) {
+	var names []string
+	for name := range p.c.searches {
+		var ok bool
+		if pattern == "them" {
+			ok = !strings.HasPrefix(name, "_")
+		} else {
+			re, err := compileGlob(pattern, false)
+			if err != nil {
+				return Rule{}, err
+			}
+			ok = re.MatchString(name)
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return Rule{}, fmt.Errorf("No searches match %s in condition", pattern)
+	}
+	sort.Strings(names)
+	rules := make([]Rule, len(names))
+	for i, name := range names {
+		rules[i] = p.c.searches[name]
+	}
+	return combineRules(op, rules), nil
+}
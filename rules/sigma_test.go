@@ -0,0 +1,178 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testSigmaRules = `
+title: Webshell access
+id: 1b2c3d4e-0000-0000-0000-000000000001
+level: high
+tags:
+  - attack.persistence
+  - attack.t1505.003
+logsource:
+  category: webserver
+detection:
+  selection_uri:
+    c-uri|contains:
+      - '/shell.php'
+      - '/cmd.jsp'
+  selection_method:
+    cs-method: post
+  filter:
+    sc-status:
+      - 404
+      - 403
+  condition: all of selection_* and not filter
+---
+title: Scanner user agents
+level: informational
+logsource:
+  category: proxy
+detection:
+  agents:
+    - cs-user-agent|startswith: 'sqlmap/'
+    - cs-user-agent: '*Nikto*'
+    - cs-user-agent|re|i: '^nuclei'
+  internal:
+    c-ip|cidr: 10.0.0.0/8
+  noreferrer:
+    cs-referrer: null
+  condition: agents and not internal and noreferrer
+---
+title: Both words
+detection:
+  words:
+    c-uri|contains|all:
+      - union
+      - select
+  condition: words
+---
+title: Counted
+detection:
+  selection:
+    cs-method: GET
+  condition: selection | count() by c-ip > 10
+---
+title: Keywords
+logsource:
+  category: firewall
+detection:
+  keywords:
+    - 'evil'
+  odd:
+    cs-version: 'HTTP/1.0'
+    c-uri|base64: 'x'
+  condition: keywords or odd
+---
+title: Broken
+detection:
+  selection:
+    cs-method: GET
+  condition: selection and missing
+`
+
+func TestParseSigmaRules(t *testing.T) {
+	rules, err := ParseSigmaRules("test.yml", []byte(testSigmaRules))
+	errs, ok := err.(SigmaErrors)
+	if !ok {
+		t.Fatalf("Expected SigmaErrors, got %v\n", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d\n", len(rules))
+	}
+	expected := []string{
+		"test.yml (Counted): Unsupported features: aggregations",
+		"test.yml (Keywords): Unsupported features: log source firewall, keyword searches, modifier base64, field cs-version",
+		"test.yml (Broken): Unknown search missing in condition",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v\n", len(expected), errs)
+	}
+	for i, e := range errs {
+		if e.Error() != expected[i] {
+			t.Errorf("Expected %q, got %q\n", expected[i], e.Error())
+		}
+	}
+
+	shell := rules[0]
+	if shell.Name != "Webshell access" || shell.Severity != "high" || !equalValues(shell.Tags, []string{"sigma", "attack.persistence", "attack.t1505.003"}) {
+		t.Errorf("Unexpected metadata %s %s %v\n", shell.Name, shell.Severity, shell.Tags)
+	}
+	if rules[1].Severity != "info" {
+		t.Errorf("Unexpected severity %s\n", rules[1].Severity)
+	}
+	if err := CompileRules(rules); err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+
+	pair := func(method, uri, agent string, code int, client string) *httpsource.RequestResponsePair {
+		req, _ := http.NewRequest(method, uri, nil)
+		if agent != "" {
+			req.Header.Set("User-Agent", agent)
+		}
+		return &httpsource.RequestResponsePair{
+			Request:    req,
+			Response:   &http.Response{StatusCode: code, Header: make(http.Header)},
+			ClientAddr: &net.TCPAddr{IP: net.ParseIP(client), Port: 40000},
+		}
+	}
+	withReferer := pair("GET", "http://example.com/", "sqlmap/1.5", 200, "192.0.2.1")
+	withReferer.Request.Header.Set("Referer", "http://example.com/")
+
+	tests := []struct {
+		rule     int
+		pair     *httpsource.RequestResponsePair
+		expected bool
+	}{
+		{0, pair("POST", "http://example.com/uploads/SHELL.php?c=id", "", 200, "192.0.2.1"), true},
+		{0, pair("POST", "http://example.com/uploads/shell.php", "", 404, "192.0.2.1"), false},
+		{0, pair("GET", "http://example.com/uploads/shell.php", "", 200, "192.0.2.1"), false},
+		{1, pair("GET", "http://example.com/", "sqlmap/1.5", 200, "192.0.2.1"), true},
+		{1, pair("GET", "http://example.com/", "Mozilla/5.0 (Nikto/2.1.6)", 200, "192.0.2.1"), true},
+		{1, pair("GET", "http://example.com/", "Nuclei - Open-source project", 200, "192.0.2.1"), true},
+		{1, pair("GET", "http://example.com/", "Mozilla/5.0", 200, "192.0.2.1"), false},
+		{1, pair("GET", "http://example.com/", "sqlmap/1.5", 200, "10.1.1.1"), false},
+		{1, withReferer, false},
+		{2, pair("GET", "http://example.com/?q=UNION+ALL+SELECT", "", 200, "192.0.2.1"), true},
+		{2, pair("GET", "http://example.com/?q=union", "", 200, "192.0.2.1"), false},
+	}
+	for i, test := range tests {
+		if res := rules[test.rule].Eval(test.pair); res != test.expected {
+			t.Errorf("Test %d (%s): expected %v, got %v\n", i, rules[test.rule].Name, test.expected, res)
+		}
+	}
+}
+
+func TestSigmaValues(t *testing.T) {
+	tests := []struct {
+		value, glob, unescaped string
+		wildcard               bool
+	}{
+		{`abc`, `abc`, `abc`, false},
+		{`a*b?`, `a*b?`, `a*b?`, true},
+		{`a\*b`, `a\*b`, `a*b`, false},
+		{`C:\Windows\*`, `C:\\Windows\*`, `C:\Windows*`, false},
+		{`[x]*`, `\[x]*`, `[x]*`, true},
+	}
+	for _, test := range tests {
+		if res := hasSigmaWildcard(test.value); res != test.wildcard {
+			t.Errorf("%s: expected wildcard %v\n", test.value, test.wildcard)
+		}
+		if res := sigmaGlob(test.value); res != test.glob {
+			t.Errorf("%s: expected glob %s, got %s\n", test.value, test.glob, res)
+		}
+		if res := unescapeSigma(test.value); res != test.unescaped {
+			t.Errorf("%s: expected %s, got %s\n", test.value, test.unescaped, res)
+		}
+	}
+
+	if _, err := ParseSigmaRules("bad.yml", []byte("title: [unterminated")); err == nil || !strings.Contains(err.Error(), "bad.yml[0]") {
+		t.Errorf("Expected a YAML error, got %v\n", err)
+	}
+}
@@ -0,0 +1,608 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Suricata (and Snort) rules are converted to Rule trees when they only use
+// the HTTP subset of the syntax: the sticky buffers such as http.uri and
+// http.header, or the older http_uri style content modifiers, with content
+// (including |hex| bytes and negation), nocase, startswith, endswith and
+// pcre.  Literal addresses and ports in the header are tested against the
+// client and server; any and $VARIABLES are ignored.  msg becomes the name,
+// priority the severity, and the sid and classtype are added as tags.
+
+// SuricataError is a Suricata rule that could not be converted, either
+// because it uses keywords with no equivalent here or is invalid.
+type SuricataError struct {
+	File        string
+	Line        int
+	SID         string
+	Unsupported []string
+	Err         error
+}
+
+func (e *SuricataError) Error() string {
+	loc := fmt.Sprintf("%s:%d", e.File, e.Line)
+	if e.SID != "" {
+		loc += " (sid " + e.SID + ")"
+	}
+	if len(e.Unsupported) > 0 {
+		return fmt.Sprintf("%s: Unsupported keywords: %s", loc, strings.Join(e.Unsupported, ", "))
+	}
+	return fmt.Sprintf("%s: %v", loc, e.Err)
+}
+
+// SuricataErrors collects the rules of a file that could not be converted.
+type SuricataErrors []*SuricataError
+
+func (e SuricataErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LoadSuricataFile converts the rules in a Suricata .rules file.  See
+// ParseSuricataRules.
+func LoadSuricataFile(filename string) ([]Rule, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSuricataRules(filename, string(buf))
+}
+
+// ParseSuricataRules converts Suricata rules, one per line.  Blank lines and
+// comments are ignored, and lines ending in \ are continued.  Rules that can
+// not be converted are skipped, and returned as SuricataErrors along with
+// the rest.
+func ParseSuricataRules(filename, src string) ([]Rule, error) {
+	var rules []Rule
+	var errs SuricataErrors
+	lines := strings.Split(src, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineno := i + 1
+		line := strings.TrimSpace(lines[i])
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + strings.TrimSpace(lines[i])
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := convertSuricataRule(line)
+		if err != nil {
+			err.File, err.Line = filename, lineno
+			errs = append(errs, err)
+			continue
+		}
+		rules = append(rules, *r)
+	}
+	if len(errs) > 0 {
+		return rules, errs
+	}
+	return rules, nil
+}
+
+// suricataContent is a content or pcre match, converted to a Rule once all
+// of its modifiers have been seen.
+type suricataContent struct {
+	field                string
+	value                string
+	regex                bool
+	negated              bool
+	nocase               bool
+	startsWith, endsWith bool
+}
+
+func (c *suricataContent) rule() Rule {
+	r := Rule{Field: c.field, Value: c.value}
+	switch {
+	case c.regex:
+		r.Operator = "~="
+	case c.startsWith && c.endsWith:
+		r.Operator, r.Value = "~=", "^"+regexp.QuoteMeta(c.value)+"$"
+		if c.nocase {
+			r.Value = "(?i)" + r.Value
+		}
+	case c.startsWith:
+		r.Operator = "startswith"
+	case c.endsWith:
+		r.Operator = "endswith"
+	default:
+		r.Operator = "contains"
+	}
+	if c.nocase && r.Operator != "~=" {
+		r.Operator += "-i"
+	}
+	if c.negated {
+		return Rule{Operator: "not", Rules: []Rule{r}}
+	}
+	return r
+}
+
+type suricataConverter struct {
+	toClient    bool
+	buffer      string
+	contents    []*suricataContent
+	conditions  []Rule
+	unsupported []string
+}
+
+func (c *suricataConverter) unsupportedKeyword(kw string) {
+	c.unsupported = appendUnique(c.unsupported, kw)
+}
+
+// Keywords with no effect on matching
+var suricataIgnored = map[string]bool{
+	"rev": true, "gid": true, "reference": true, "metadata": true, "target": true,
+	"fast_pattern": true, "app-layer-protocol": true,
+}
+
+// Sticky buffers, and the equivalent content modifiers, by the field they
+// select in requests.  Fields from headers present in both directions are
+// switched to the response by flow:to_client.
+var suricataBuffers = map[string]string{
+	"http.uri": "request.url", "http.uri.raw": "request.url",
+	"http_uri": "request.url", "http_raw_uri": "request.url",
+	"http.method": "request.method", "http_method": "request.method",
+	"http.host": "request.host", "http.host.raw": "request.host",
+	"http_host": "request.host", "http_raw_host": "request.host",
+	"http.header": "request.headers", "http.header.raw": "request.headers",
+	"http_header": "request.headers", "http_raw_header": "request.headers",
+	"http.cookie": "request.header.cookie", "http_cookie": "request.header.cookie",
+	"http.user_agent": "request.header.user-agent", "http_user_agent": "request.header.user-agent",
+	"http.referer":      "request.header.referer",
+	"http.accept":       "request.header.accept",
+	"http.accept_lang":  "request.header.accept-language",
+	"http.accept_enc":   "request.header.accept-encoding",
+	"http.connection":   "request.header.connection",
+	"http.content_type": "request.header.content-type",
+	"http.content_len":  "request.header.content-length",
+	"http.request_body": "request.body", "http.client_body": "request.body",
+	"http_client_body":   "request.body",
+	"http.response_body": "response.body", "http.server_body": "response.body",
+	"http_server_body": "response.body", "file.data": "response.body", "file_data": "response.body",
+	"http.stat_code": "response.code", "http_stat_code": "response.code",
+	"http.stat_msg": "response.status", "http_stat_msg": "response.status",
+	"http.location": "response.header.location",
+	"http.server":   "response.header.server",
+}
+
+// Buffers selected by pcre flags
+var suricataPcreBuffers = map[rune]string{
+	'U': "http.uri", 'I': "http.uri.raw", 'M': "http.method", 'C': "http.cookie",
+	'H': "http.header", 'D': "http.header.raw", 'P': "http.request_body",
+	'Q': "http.response_body", 'S': "http.stat_code", 'Y': "http.stat_msg",
+	'V': "http.user_agent", 'W': "http.host", 'Z': "http.host.raw",
+}
+
+func (c *suricataConverter) bufferField(name string) string {
+	field := suricataBuffers[name]
+	if !c.toClient {
+		return field
+	}
+	switch field {
+	case "request.header.cookie":
+		return "response.header.set-cookie"
+	case "request.headers", "request.header.content-type", "request.header.content-length":
+		return "response" + strings.TrimPrefix(field, "request")
+	}
+	return field
+}
+
+func (c *suricataConverter) last() *suricataContent {
+	if len(c.contents) == 0 {
+		return nil
+	}
+	return c.contents[len(c.contents)-1]
+}
+
+func convertSuricataRule(line string) (*Rule, *SuricataError) {
+	open := strings.IndexByte(line, '(')
+	if open == -1 || !strings.HasSuffix(line, ")") {
+		return nil, &SuricataError{Err: errors.New("Expected options in parentheses")}
+	}
+	header := strings.Fields(line[:open])
+	if len(header) != 7 {
+		return nil, &SuricataError{Err: fmt.Errorf("Invalid rule header: %s", strings.TrimSpace(line[:open]))}
+	}
+	options, err := splitSuricataOptions(line[open+1 : len(line)-1])
+	if err != nil {
+		return nil, &SuricataError{Err: err}
+	}
+
+	r := &Rule{Tags: []string{"suricata"}}
+	c := &suricataConverter{}
+	var sid string
+	// Metadata and direction first, as the direction selects fields
+	for _, o := range options {
+		switch o.name {
+		case "sid":
+			sid = o.value
+		case "flow":
+			for _, f := range strings.Split(o.value, ",") {
+				switch f = strings.TrimSpace(f); f {
+				case "to_client", "from_server":
+					c.toClient = true
+				case "to_server", "from_client", "established", "only_stream", "no_stream":
+				default:
+					c.unsupportedKeyword("flow:" + f)
+				}
+			}
+		case "msg":
+			if _, msg, err := suricataValue(o.value); err == nil {
+				r.Name = unescapeSuricata(msg, true)
+			} else {
+				r.Name = o.value
+			}
+		case "classtype":
+			r.Tags = append(r.Tags, o.value)
+		case "priority":
+			p, err := strconv.Atoi(o.value)
+			if err != nil {
+				return nil, &SuricataError{SID: sid, Err: fmt.Errorf("Invalid priority: %s", o.value)}
+			}
+			r.Severity = suricataSeverity(p)
+		}
+	}
+	if sid != "" {
+		r.Tags = append(r.Tags, "sid:"+sid)
+		if r.Name == "" {
+			r.Name = "sid:" + sid
+		}
+	}
+	fail := func(err error) (*Rule, *SuricataError) {
+		return nil, &SuricataError{SID: sid, Err: err}
+	}
+
+	if err := c.convertHeader(header); err != nil {
+		return fail(err)
+	}
+	for _, o := range options {
+		if err := c.convertOption(o); err != nil {
+			return fail(err)
+		}
+	}
+	for _, content := range c.contents {
+		if content.field == "" {
+			c.unsupportedKeyword("content outside an HTTP buffer")
+			continue
+		}
+		c.conditions = append(c.conditions, content.rule())
+	}
+	if len(c.unsupported) > 0 {
+		return nil, &SuricataError{SID: sid, Unsupported: c.unsupported}
+	}
+
+	switch len(c.conditions) {
+	case 0:
+		return fail(errors.New("No HTTP conditions"))
+	case 1:
+		cond := c.conditions[0]
+		r.Operator, r.Field, r.Value, r.Values, r.Rules = cond.Operator, cond.Field, cond.Value, cond.Values, cond.Rules
+	default:
+		r.Operator, r.Rules = "and", c.conditions
+	}
+	return r, nil
+}
+
+// suricataSeverity maps a priority, 1 being the highest, to a severity.
+func suricataSeverity(priority int) string {
+	switch {
+	case priority <= 1:
+		return "high"
+	case priority == 2:
+		return "medium"
+	case priority == 3:
+		return "low"
+	}
+	return "info"
+}
+
+// convertHeader converts the action, protocol, addresses and ports.
+func (c *suricataConverter) convertHeader(header []string) error {
+	switch header[0] {
+	case "alert", "drop", "reject", "rejectsrc", "rejectdst", "rejectboth":
+	default:
+		c.unsupportedKeyword("action " + header[0])
+	}
+	switch header[1] {
+	case "http", "http1", "tcp":
+	default:
+		c.unsupportedKeyword("protocol " + header[1])
+	}
+	src, dst := "client", "server"
+	if c.toClient {
+		src, dst = dst, src
+	}
+	switch header[4] {
+	case "->":
+	case "<>":
+		for _, spec := range []string{header[2], header[3], header[5], header[6]} {
+			if !suricataAny(spec) {
+				c.unsupportedKeyword("bidirectional rule with addresses or ports")
+				return nil
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid direction: %s", header[4])
+	}
+	for _, hdr := range []struct{ spec, field string }{
+		{header[2], src + ".ip"}, {header[3], src + ".port"},
+		{header[5], dst + ".ip"}, {header[6], dst + ".port"},
+	} {
+		if err := c.convertAddress(hdr.spec, hdr.field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func suricataAny(spec string) bool {
+	return spec == "any" || strings.HasPrefix(spec, "$")
+}
+
+// convertAddress tests an address or port from the header, which may be a
+// [list], negated with !.
+func (c *suricataConverter) convertAddress(spec, field string) error {
+	if suricataAny(spec) {
+		return nil
+	}
+	negated := strings.HasPrefix(spec, "!")
+	spec = strings.TrimPrefix(spec, "!")
+	elems := []string{spec}
+	if strings.HasPrefix(spec, "[") && strings.HasSuffix(spec, "]") {
+		elems = strings.Split(spec[1:len(spec)-1], ",")
+	}
+	for _, e := range elems {
+		if e == "" || strings.ContainsAny(e, "!$[]") || e == "any" {
+			c.unsupportedKeyword("address or port list " + spec)
+			return nil
+		}
+	}
+
+	var cond Rule
+	if strings.HasSuffix(field, ".ip") {
+		if _, err := parsePrefixes(elems); err != nil {
+			return err
+		}
+		cond = Rule{Operator: "in-cidr", Field: field, Values: elems}
+	} else {
+		var ports []string
+		var conds []Rule
+		for _, e := range elems {
+			if !strings.ContainsRune(e, ':') {
+				if _, err := strconv.ParseUint(e, 10, 16); err != nil {
+					return fmt.Errorf("Invalid port: %s", e)
+				}
+				ports = append(ports, e)
+				continue
+			}
+			lo, hi, _ := splitFirst(e, ":")
+			if lo == "" {
+				lo = "0"
+			}
+			if hi == "" {
+				hi = "65535"
+			}
+			conds = append(conds, Rule{Operator: "in-range", Field: field, Value: lo + "-" + hi})
+		}
+		if len(ports) > 0 {
+			conds = append(conds, Rule{Operator: "in", Field: field, Values: ports})
+		}
+		cond = conds[0]
+		if len(conds) > 1 {
+			cond = Rule{Operator: "or", Rules: conds}
+		}
+	}
+	if negated {
+		cond = Rule{Operator: "not", Rules: []Rule{cond}}
+	}
+	c.conditions = append(c.conditions, cond)
+	return nil
+}
+
+func (c *suricataConverter) convertOption(o suricataOption) error {
+	switch o.name {
+	case "msg", "sid", "flow", "classtype", "priority":
+		return nil
+	case "content":
+		negated, value, err := suricataValue(o.value)
+		if err != nil {
+			return err
+		}
+		content, err := decodeSuricataContent(value)
+		if err != nil {
+			return err
+		}
+		c.contents = append(c.contents, &suricataContent{field: c.bufferField(c.buffer), value: content, negated: negated})
+		return nil
+	case "pcre":
+		return c.convertPcre(o.value)
+	case "nocase", "startswith", "endswith":
+		last := c.last()
+		if last == nil || last.regex {
+			return fmt.Errorf("%s must follow a content", o.name)
+		}
+		switch o.name {
+		case "nocase":
+			last.nocase = true
+		case "startswith":
+			last.startsWith = true
+		case "endswith":
+			last.endsWith = true
+		}
+		return nil
+	case "pkt_data":
+		c.buffer = ""
+		return nil
+	}
+	if _, ok := suricataBuffers[o.name]; ok {
+		if strings.HasPrefix(o.name, "http_") {
+			// Content modifier, applying to the content before it
+			last := c.last()
+			if last == nil || last.regex {
+				return fmt.Errorf("%s must follow a content", o.name)
+			}
+			last.field = c.bufferField(o.name)
+		} else {
+			c.buffer = o.name
+		}
+		return nil
+	}
+	if !suricataIgnored[o.name] {
+		c.unsupportedKeyword(o.name)
+	}
+	return nil
+}
+
+// convertPcre converts a /regex/flags, where upper case flags select the
+// buffer.
+func (c *suricataConverter) convertPcre(value string) error {
+	negated, value, err := suricataValue(value)
+	if err != nil {
+		return err
+	}
+	value = unescapeSuricata(value, false)
+	end := strings.LastIndexByte(value, '/')
+	if !strings.HasPrefix(value, "/") || end == 0 {
+		return fmt.Errorf("Invalid pcre: %s", value)
+	}
+	re, flags := value[1:end], ""
+	buffer := c.buffer
+	for _, f := range value[end+1:] {
+		switch {
+		case f == 'i' || f == 's' || f == 'm':
+			flags += string(f)
+		case suricataPcreBuffers[f] != "":
+			buffer = suricataPcreBuffers[f]
+		default:
+			c.unsupportedKeyword(fmt.Sprintf("pcre flag %c", f))
+		}
+	}
+	if flags != "" {
+		re = "(?" + flags + ")" + re
+	}
+	if _, err := regexp.Compile(re); err != nil {
+		return fmt.Errorf("Invalid pcre: %v", err)
+	}
+	c.contents = append(c.contents, &suricataContent{field: c.bufferField(buffer), value: re, regex: true, negated: negated})
+	return nil
+}
+
+type suricataOption struct {
+	name, value string
+}
+
+// splitSuricataOptions splits name:value; options, allowing \; and quoted
+// semicolons in values.
+func splitSuricataOptions(s string) ([]suricataOption, error) {
+	var options []suricataOption
+	var cur strings.Builder
+	quoted := false
+	add := func() {
+		opt := strings.TrimSpace(cur.String())
+		cur.Reset()
+		if opt == "" {
+			return
+		}
+		name, value := opt, ""
+		if i := strings.IndexByte(opt, ':'); i != -1 {
+			name, value = strings.TrimSpace(opt[:i]), strings.TrimSpace(opt[i+1:])
+		}
+		options = append(options, suricataOption{name, value})
+	}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			cur.WriteByte(s[i])
+			if i+1 < len(s) {
+				i++
+				cur.WriteByte(s[i])
+			}
+		case '"':
+			quoted = !quoted
+			cur.WriteByte(s[i])
+		case ';':
+			if quoted {
+				cur.WriteByte(s[i])
+			} else {
+				add()
+			}
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+	if quoted {
+		return nil, errors.New("Unterminated string in options")
+	}
+	add()
+	return options, nil
+}
+
+// suricataValue returns a quoted value, which may be negated with !, with
+// the quotes removed.
+func suricataValue(value string) (bool, string, error) {
+	negated := strings.HasPrefix(value, "!")
+	value = strings.TrimSpace(strings.TrimPrefix(value, "!"))
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return false, "", fmt.Errorf("Expected a quoted value: %s", value)
+	}
+	return negated, value[1 : len(value)-1], nil
+}
+
+// unescapeSuricata removes the escapes from \" \; and \:, and from \\ if
+// all is set.  Escapes in regular expressions are otherwise left alone.
+func unescapeSuricata(s string, all bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (strings.IndexByte("\";:", s[i+1]) != -1 || (all && s[i+1] == '\\')) {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// decodeSuricataContent unescapes a content value and decodes |hex| bytes.
+func decodeSuricataContent(s string) (string, error) {
+	s = unescapeSuricata(s, true)
+	var buf strings.Builder
+	for {
+		start := strings.IndexByte(s, '|')
+		if start == -1 {
+			buf.WriteString(s)
+			break
+		}
+		end := strings.IndexByte(s[start+1:], '|')
+		if end == -1 {
+			return "", fmt.Errorf("Unterminated hex in content: %s", s)
+		}
+		buf.WriteString(s[:start])
+		for _, h := range strings.Fields(s[start+1 : start+1+end]) {
+			if len(h)%2 != 0 {
+				return "", fmt.Errorf("Invalid hex in content: %s", h)
+			}
+			for i := 0; i < len(h); i += 2 {
+				b, err := strconv.ParseUint(h[i:i+2], 16, 8)
+				if err != nil {
+					return "", fmt.Errorf("Invalid hex in content: %s", h)
+				}
+				buf.WriteByte(byte(b))
+			}
+		}
+		s = s[start+1+end+1:]
+	}
+	if buf.Len() == 0 {
+		return "", errors.New("Empty content")
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,215 @@
+package rules
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Matir/httpwatch/httpsource"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Fields may be followed by a pipeline of transforms applied to each value,
+// such as request.url.query|urldecode|lower.  A decoder followed by *, as in
+// urldecode*, is applied repeatedly until the value stops changing or no
+// longer decodes to text, to look through double encoding.  Values a decoder
+// cannot decode at all are dropped.
+
+// transform converts a value, returning false if it does not apply.
+type transform struct {
+	apply   func(string) (string, bool)
+	decoder bool
+}
+
+// Transforms by name, as used after | in a field
+var transforms = make(map[string]*transform)
+
+func registerTransform(name string, apply func(string) (string, bool), decoder bool) {
+	transforms[name] = &transform{apply: apply, decoder: decoder}
+}
+
+// Recursive decoding stops after this many rounds
+const maxDecodeRounds = 8
+
+// transformStep is a transform in a pipeline.
+type transformStep struct {
+	*transform
+	recursive bool
+}
+
+func (s transformStep) run(val string) (string, bool) {
+	out, ok := s.apply(val)
+	if !ok || !s.recursive {
+		return out, ok
+	}
+	for i := 1; i < maxDecodeRounds; i++ {
+		next, ok := s.apply(out)
+		if !ok || next == out || !utf8.ValidString(next) {
+			break
+		}
+		out = next
+	}
+	return out, true
+}
+
+// isTransformName returns true if s looks like the name of a transform,
+// rather than part of a field such as an XPath union.
+func isTransformName(s string) bool {
+	s = strings.TrimSuffix(s, "*")
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= 'a' && s[i] <= 'z' || s[i] >= '0' && s[i] <= '9' || s[i] == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitTransforms splits a field into the field itself and its pipeline of
+// transforms.
+func splitTransforms(field string) (string, []transformStep, error) {
+	var names []string
+	for {
+		i := strings.LastIndexByte(field, '|')
+		if i == -1 || !isTransformName(field[i+1:]) {
+			break
+		}
+		names = append(names, field[i+1:])
+		field = field[:i]
+	}
+	steps := make([]transformStep, 0, len(names))
+	for i := len(names) - 1; i >= 0; i-- {
+		name := strings.TrimSuffix(names[i], "*")
+		t, ok := transforms[name]
+		if !ok {
+			return "", nil, fmt.Errorf("Unknown transform: %s", name)
+		}
+		recursive := name != names[i]
+		if recursive && !t.decoder {
+			return "", nil, fmt.Errorf("Transform %s cannot be repeated", name)
+		}
+		steps = append(steps, transformStep{t, recursive})
+	}
+	return field, steps, nil
+}
+
+// Apply the pipeline to each value of a field
+func buildTransformGetter(getter FieldGetter, steps []transformStep) FieldGetter {
+	return func(pair *httpsource.RequestResponsePair) ([]string, error) {
+		vals, err := getter(pair)
+		if err != nil {
+			return nil, err
+		}
+		var out []string
+	values:
+		for _, v := range vals {
+			for _, s := range steps {
+				var ok bool
+				if v, ok = s.run(v); !ok {
+					continue values
+				}
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+}
+
+// urlDecode decodes %XX escapes and + as a space, leaving invalid escapes
+// as they are.
+func urlDecode(val string) (string, bool) {
+	if !strings.ContainsAny(val, "%+") {
+		return val, true
+	}
+	var buf strings.Builder
+	for i := 0; i < len(val); i++ {
+		switch c := val[i]; {
+		case c == '+':
+			buf.WriteByte(' ')
+		case c == '%' && i+2 < len(val) && isHexDigit(val[i+1]) && isHexDigit(val[i+2]):
+			b, _ := strconv.ParseUint(val[i+1:i+3], 16, 8)
+			buf.WriteByte(byte(b))
+			i += 2
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String(), true
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// base64Decode accepts the standard and URL alphabets, with or without
+// padding.  A scheme before the data, as in Basic credentials, is skipped.
+func base64Decode(val string) (string, bool) {
+	val = strings.TrimSpace(val)
+	if i := strings.LastIndexAny(val, " \t"); i != -1 {
+		val = val[i+1:]
+	}
+	if val == "" {
+		return "", false
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if buf, err := enc.DecodeString(val); err == nil {
+			return string(buf), true
+		}
+	}
+	return "", false
+}
+
+func hexDecode(val string) (string, bool) {
+	buf, err := hex.DecodeString(strings.TrimSpace(val))
+	if err != nil || len(buf) == 0 {
+		return "", false
+	}
+	return string(buf), true
+}
+
+// The header and claims of a JWT as compact JSON, {"claims":...,"header":...}
+func jwtDecode(val string) (string, bool) {
+	tok := decodeJWT(strings.TrimSpace(val))
+	if tok == nil {
+		return "", false
+	}
+	buf, err := json.Marshal(map[string]interface{}{"header": tok.header, "claims": tok.claims})
+	if err != nil {
+		return "", false
+	}
+	return string(buf), true
+}
+
+func init() {
+	registerTransform("urldecode", urlDecode, true)
+	registerTransform("base64", base64Decode, true)
+	registerTransform("hex", hexDecode, true)
+	registerTransform("htmldecode", func(v string) (string, bool) { return html.UnescapeString(v), true }, true)
+	registerTransform("jwt", jwtDecode, false)
+	registerTransform("lower", func(v string) (string, bool) { return strings.ToLower(v), true }, false)
+	registerTransform("upper", func(v string) (string, bool) { return strings.ToUpper(v), true }, false)
+	registerTransform("trim", func(v string) (string, bool) { return strings.TrimSpace(v), true }, false)
+	registerTransform("length", func(v string) (string, bool) { return strconv.Itoa(len(v)), true }, false)
+	sha256Hex := func(v string) (string, bool) {
+		sum := sha256.Sum256([]byte(v))
+		return hex.EncodeToString(sum[:]), true
+	}
+	registerTransform("hash", sha256Hex, false)
+	registerTransform("sha256", sha256Hex, false)
+	registerTransform("md5", func(v string) (string, bool) {
+		sum := md5.Sum([]byte(v))
+		return hex.EncodeToString(sum[:]), true
+	}, false)
+	registerTransform("sha1", func(v string) (string, bool) {
+		sum := sha1.Sum([]byte(v))
+		return hex.EncodeToString(sum[:]), true
+	}, false)
+}
@@ -0,0 +1,1338 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A pure Go implementation of a subset of YARA, enough for the string and
+// condition based rules typically written for web shells and payloads.
+//
+// Supported are text strings (with the nocase, wide, ascii, fullword and
+// private modifiers), hex strings (with ?? and nibble wildcards, [n-m] jumps
+// of up to 1024 bytes and (a|b) alternatives), and regular expressions (with
+// the i and s flags, and the nocase, fullword, ascii and private
+// modifiers).  Conditions may use and, or, not, comparisons, $a, $a at n,
+// $a in (lo..hi), #a, @a[i], !a[i], filesize, any/all/none/n of (...) or
+// them, and earlier rules by name.  Imports, includes, for loops,
+// arithmetic, unbounded jumps and the xor and base64 modifiers are not
+// supported.
+
+// yaraRuleSet is a compiled YARA file.
+type yaraRuleSet struct {
+	rules []*yaraRule
+}
+
+type yaraRule struct {
+	name      string
+	tags      []string
+	private   bool
+	strings   []*yaraString
+	condition yaraExpr
+}
+
+type yaraString struct {
+	id       string
+	seqs     [][]yaraToken
+	re       *regexp.Regexp
+	fullword bool
+	private  bool
+}
+
+// yaraToken is one element of a text or hex string: a byte (compared under
+// mask, or case-insensitively), a jump of min to max bytes (max -1 for
+// unbounded), or alternatives.
+type yaraToken struct {
+	value, mask byte
+	nocase      bool
+	jump        bool
+	min, max    int
+	alts        [][]yaraToken
+}
+
+type yaraMatch struct {
+	offset, length int
+}
+
+// Compiled YARA files, shared by every rule using them.
+var yaraFiles = struct {
+	sync.Mutex
+	m map[string]*yaraRuleSet
+}{m: make(map[string]*yaraRuleSet)}
+
+// loadYaraFile compiles a YARA file the first time it is used.
+func loadYaraFile(filename string) (*yaraRuleSet, error) {
+	yaraFiles.Lock()
+	defer yaraFiles.Unlock()
+	if rs, ok := yaraFiles.m[filename]; ok {
+		return rs, nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := compileYara(filename, string(buf))
+	if err != nil {
+		return nil, err
+	}
+	yaraFiles.m[filename] = rs
+	return rs, nil
+}
+
+// compileYara compiles the source of a YARA file.  Errors are reported as
+// filename:line.
+func compileYara(filename, src string) (*yaraRuleSet, error) {
+	p := &yaraParser{yaraLexer: yaraLexer{filename: filename, src: src, line: 1}}
+	rs := &yaraRuleSet{}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == yaraEOF {
+			return rs, nil
+		}
+		private := false
+		for tok.is("private") || tok.is("global") {
+			if tok.is("global") {
+				return nil, p.errorf(tok.line, "global rules are not supported")
+			}
+			private = true
+			if tok, err = p.next(); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case tok.is("import"), tok.is("include"):
+			return nil, p.errorf(tok.line, "%s is not supported", tok.text)
+		case !tok.is("rule"):
+			return nil, p.errorf(tok.line, "expected rule, got %s", tok)
+		}
+		r, err := p.parseRule(rs)
+		if err != nil {
+			return nil, err
+		}
+		r.private = private
+		rs.rules = append(rs.rules, r)
+	}
+}
+
+// Lexer
+
+type yaraTokenKind int
+
+const (
+	yaraEOF yaraTokenKind = iota
+	yaraIdent
+	yaraText
+	yaraNumber
+	yaraStringID
+	yaraCountID
+	yaraOffsetID
+	yaraLengthID
+	yaraPunct
+)
+
+type yaraTok struct {
+	kind yaraTokenKind
+	text string
+	num  int64
+	line int
+}
+
+func (t yaraTok) is(word string) bool {
+	return (t.kind == yaraIdent || t.kind == yaraPunct) && t.text == word
+}
+
+func (t yaraTok) String() string {
+	if t.kind == yaraEOF {
+		return "end of file"
+	}
+	return strconv.Quote(t.text)
+}
+
+type yaraLexer struct {
+	filename string
+	src      string
+	pos      int
+	line     int
+	peeked   *yaraTok
+}
+
+func (l *yaraLexer) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", l.filename, line, fmt.Sprintf(format, args...))
+}
+
+func isYaraIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// skipSpace skips whitespace and comments.
+func (l *yaraLexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case strings.HasPrefix(l.src[l.pos:], "//"):
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end == -1 {
+				return l.errorf(l.line, "unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *yaraLexer) peek() (yaraTok, error) {
+	if l.peeked == nil {
+		tok, err := l.lex()
+		if err != nil {
+			return tok, err
+		}
+		l.peeked = &tok
+	}
+	return *l.peeked, nil
+}
+
+func (l *yaraLexer) next() (yaraTok, error) {
+	tok, err := l.peek()
+	l.peeked = nil
+	return tok, err
+}
+
+func (l *yaraLexer) lex() (yaraTok, error) {
+	if err := l.skipSpace(); err != nil {
+		return yaraTok{}, err
+	}
+	tok := yaraTok{line: l.line}
+	if l.pos >= len(l.src) {
+		return tok, nil
+	}
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case c == '"':
+		s, err := l.lexText()
+		tok.kind, tok.text = yaraText, s
+		return tok, err
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && isYaraIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		text := l.src[start:l.pos]
+		mult := int64(1)
+		if strings.HasSuffix(text, "KB") {
+			text, mult = text[:len(text)-2], 1024
+		} else if strings.HasSuffix(text, "MB") {
+			text, mult = text[:len(text)-2], 1024*1024
+		}
+		n, err := strconv.ParseInt(text, 0, 64)
+		if err != nil {
+			return tok, l.errorf(tok.line, "invalid number %s", l.src[start:l.pos])
+		}
+		tok.kind, tok.text, tok.num = yaraNumber, l.src[start:l.pos], n*mult
+		return tok, nil
+	case isYaraIdentChar(c):
+		for l.pos < len(l.src) && isYaraIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		tok.kind, tok.text = yaraIdent, l.src[start:l.pos]
+		return tok, nil
+	case c == '$' || c == '#' || c == '@' || (c == '!' && !strings.HasPrefix(l.src[l.pos:], "!=")):
+		l.pos++
+		for l.pos < len(l.src) && isYaraIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		if c == '$' && l.pos < len(l.src) && l.src[l.pos] == '*' {
+			l.pos++
+		}
+		tok.kind = map[byte]yaraTokenKind{'$': yaraStringID, '#': yaraCountID, '@': yaraOffsetID, '!': yaraLengthID}[c]
+		// All refer to the string $name
+		tok.text = "$" + l.src[start+1:l.pos]
+		return tok, nil
+	}
+	for _, p := range []string{"..", "==", "!=", "<=", ">=", "<", ">", "{", "}", "(", ")", "[", "]", ":", "=", ",", "-", "|"} {
+		if strings.HasPrefix(l.src[l.pos:], p) {
+			l.pos += len(p)
+			tok.kind, tok.text = yaraPunct, p
+			return tok, nil
+		}
+	}
+	return tok, l.errorf(tok.line, "unexpected character %q", c)
+}
+
+// lexText reads a double-quoted string with escapes.
+func (l *yaraLexer) lexText() (string, error) {
+	line := l.line
+	var buf []byte
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return string(buf), nil
+		case '\n':
+			return "", l.errorf(line, "unterminated string")
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.src) {
+				return "", l.errorf(line, "unterminated string")
+			}
+			switch e := l.src[l.pos]; e {
+			case '"', '\\':
+				buf = append(buf, e)
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'x':
+				if l.pos+2 >= len(l.src) {
+					return "", l.errorf(line, "invalid \\x escape")
+				}
+				b, err := strconv.ParseUint(l.src[l.pos+1:l.pos+3], 16, 8)
+				if err != nil {
+					return "", l.errorf(line, "invalid \\x escape")
+				}
+				buf = append(buf, byte(b))
+				l.pos += 2
+			default:
+				return "", l.errorf(line, "invalid escape \\%c", e)
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", l.errorf(line, "unterminated string")
+}
+
+// lexHex reads the body of a hex string, after the opening {.
+func (l *yaraLexer) lexHex(depth int) ([]yaraToken, error) {
+	var seq []yaraToken
+	for {
+		if err := l.skipSpace(); err != nil {
+			return nil, err
+		}
+		if l.pos >= len(l.src) {
+			return nil, l.errorf(l.line, "unterminated hex string")
+		}
+		c := l.src[l.pos]
+		switch {
+		case c == '}' && depth == 0, (c == ')' || c == '|') && depth > 0:
+			return seq, nil
+		case c == '[':
+			end := strings.IndexByte(l.src[l.pos:], ']')
+			if end == -1 {
+				return nil, l.errorf(l.line, "unterminated jump")
+			}
+			jump, err := parseYaraJump(strings.TrimSpace(l.src[l.pos+1 : l.pos+end]))
+			if err != nil {
+				return nil, l.errorf(l.line, "%v", err)
+			}
+			seq = append(seq, jump)
+			l.pos += end + 1
+		case c == '(':
+			alt := yaraToken{}
+			for {
+				l.pos++
+				s, err := l.lexHex(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				alt.alts = append(alt.alts, s)
+				if l.src[l.pos] == ')' {
+					l.pos++
+					break
+				}
+			}
+			seq = append(seq, alt)
+		default:
+			if l.pos+1 >= len(l.src) {
+				return nil, l.errorf(l.line, "invalid hex string")
+			}
+			tok, err := parseYaraHexByte(l.src[l.pos : l.pos+2])
+			if err != nil {
+				return nil, l.errorf(l.line, "%v", err)
+			}
+			seq = append(seq, tok)
+			l.pos += 2
+		}
+	}
+}
+
+func parseYaraHexByte(s string) (yaraToken, error) {
+	tok := yaraToken{}
+	for i := 0; i < 2; i++ {
+		tok.value <<= 4
+		tok.mask <<= 4
+		if s[i] == '?' {
+			continue
+		}
+		n, err := strconv.ParseUint(s[i:i+1], 16, 8)
+		if err != nil {
+			return tok, fmt.Errorf("invalid hex byte %s", s)
+		}
+		tok.value |= byte(n)
+		tok.mask |= 0xf
+	}
+	return tok, nil
+}
+
+// parseYaraJump parses n, n-m, n- or - as the contents of [].
+func parseYaraJump(s string) (yaraToken, error) {
+	tok := yaraToken{jump: true, max: -1}
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		lo, hi = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+	}
+	var err error
+	if lo != "" {
+		if tok.min, err = strconv.Atoi(lo); err != nil {
+			return tok, fmt.Errorf("invalid jump [%s]", s)
+		}
+	}
+	if hi != "" {
+		if tok.max, err = strconv.Atoi(hi); err != nil || tok.max < tok.min {
+			return tok, fmt.Errorf("invalid jump [%s]", s)
+		}
+	}
+	return tok, nil
+}
+
+// checkYaraJumps returns an error for a jump in seq, or in its alternatives,
+// that is unbounded or longer than maxYaraJump.
+func checkYaraJumps(seq []yaraToken) error {
+	for _, tok := range seq {
+		switch {
+		case tok.jump && tok.max < 0:
+			return fmt.Errorf("unbounded jump [%d-] is not supported, use at most [%d-%d]", tok.min, tok.min, maxYaraJump)
+		case tok.jump && tok.max > maxYaraJump:
+			return fmt.Errorf("jump [%d-%d] is longer than %d bytes", tok.min, tok.max, maxYaraJump)
+		}
+		for _, alt := range tok.alts {
+			if err := checkYaraJumps(alt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lexRegex reads a regular expression, after the opening /, and its flags.
+func (l *yaraLexer) lexRegex() (string, string, error) {
+	line := l.line
+	var buf strings.Builder
+	for ; l.pos < len(l.src); l.pos++ {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			return "", "", l.errorf(line, "unterminated regular expression")
+		case c == '\\' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '/':
+			buf.WriteByte('/')
+			l.pos++
+		case c == '\\' && l.pos+1 < len(l.src):
+			buf.WriteString(l.src[l.pos : l.pos+2])
+			l.pos++
+		case c == '/':
+			l.pos++
+			start := l.pos
+			for l.pos < len(l.src) && (l.src[l.pos] == 'i' || l.src[l.pos] == 's') {
+				l.pos++
+			}
+			return buf.String(), l.src[start:l.pos], nil
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", "", l.errorf(line, "unterminated regular expression")
+}
+
+// Parser
+
+type yaraParser struct {
+	yaraLexer
+	rule *yaraRule
+	rs   *yaraRuleSet
+}
+
+func (p *yaraParser) expect(word string) (yaraTok, error) {
+	tok, err := p.next()
+	if err != nil {
+		return tok, err
+	}
+	if !tok.is(word) {
+		return tok, p.errorf(tok.line, "expected %s, got %s", word, tok)
+	}
+	return tok, nil
+}
+
+func (p *yaraParser) parseRule(rs *yaraRuleSet) (*yaraRule, error) {
+	name, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if name.kind != yaraIdent {
+		return nil, p.errorf(name.line, "expected a rule name, got %s", name)
+	}
+	for _, r := range rs.rules {
+		if r.name == name.text {
+			return nil, p.errorf(name.line, "duplicate rule %s", name.text)
+		}
+	}
+	r := &yaraRule{name: name.text}
+	p.rule, p.rs = r, rs
+
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.is(":") {
+		for {
+			if tok, err = p.next(); err != nil {
+				return nil, err
+			}
+			if tok.kind != yaraIdent {
+				break
+			}
+			r.tags = append(r.tags, tok.text)
+		}
+	}
+	if !tok.is("{") {
+		return nil, p.errorf(tok.line, "expected {, got %s", tok)
+	}
+
+	for {
+		section, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		switch {
+		case section.is("meta"):
+			if err := p.parseMeta(); err != nil {
+				return nil, err
+			}
+		case section.is("strings"):
+			if err := p.parseStrings(); err != nil {
+				return nil, err
+			}
+		case section.is("condition"):
+			if r.condition, err = p.parseOr(); err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			return r, nil
+		default:
+			return nil, p.errorf(section.line, "unknown section %s", section)
+		}
+	}
+}
+
+// Metadata is checked but not used
+func (p *yaraParser) parseMeta() error {
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return err
+		}
+		if tok.kind != yaraIdent || tok.is("strings") || tok.is("condition") {
+			return nil
+		}
+		p.next()
+		if _, err := p.expect("="); err != nil {
+			return err
+		}
+		if tok, err = p.next(); err != nil {
+			return err
+		}
+		if tok.is("-") {
+			tok, err = p.next()
+		}
+		if err != nil {
+			return err
+		}
+		if tok.kind != yaraText && tok.kind != yaraNumber && !tok.is("true") && !tok.is("false") {
+			return p.errorf(tok.line, "invalid metadata value %s", tok)
+		}
+	}
+}
+
+func (p *yaraParser) parseStrings() error {
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return err
+		}
+		if tok.kind != yaraStringID {
+			return nil
+		}
+		p.next()
+		if strings.HasSuffix(tok.text, "*") {
+			return p.errorf(tok.line, "invalid string identifier %s", tok.text)
+		}
+		for _, s := range p.rule.strings {
+			if s.id == tok.text && s.id != "$" {
+				return p.errorf(tok.line, "duplicate string %s", tok.text)
+			}
+		}
+		if _, err := p.expect("="); err != nil {
+			return err
+		}
+		s, err := p.parseStringValue(tok)
+		if err != nil {
+			return err
+		}
+		p.rule.strings = append(p.rule.strings, s)
+	}
+}
+
+func (p *yaraParser) parseStringValue(id yaraTok) (*yaraString, error) {
+	if err := p.skipSpace(); err != nil {
+		return nil, err
+	}
+	s := &yaraString{id: id.text}
+	if p.pos >= len(p.src) {
+		return nil, p.errorf(p.line, "expected a string value")
+	}
+	var text string
+	var reSrc, reFlags string
+	kind := p.src[p.pos]
+	switch kind {
+	case '"':
+		var err error
+		if text, err = p.lexText(); err != nil {
+			return nil, err
+		}
+		if text == "" {
+			return nil, p.errorf(id.line, "empty string %s", id.text)
+		}
+	case '{':
+		p.pos++
+		seq, err := p.lexHex(0)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+		if len(seq) == 0 || seq[0].jump || seq[len(seq)-1].jump {
+			return nil, p.errorf(id.line, "hex string %s must start and end with a byte", id.text)
+		}
+		if err := checkYaraJumps(seq); err != nil {
+			return nil, p.errorf(id.line, "hex string %s: %v", id.text, err)
+		}
+		s.seqs = [][]yaraToken{seq}
+	case '/':
+		p.pos++
+		var err error
+		if reSrc, reFlags, err = p.lexRegex(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, p.errorf(p.line, "expected a string value for %s", id.text)
+	}
+
+	modifiers := make(map[string]bool)
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind != yaraIdent || tok.is("condition") || tok.is("strings") || tok.is("meta") {
+			break
+		}
+		p.next()
+		allowed := map[byte][]string{
+			'"': {"nocase", "wide", "ascii", "fullword", "private"},
+			'{': {"private"},
+			'/': {"nocase", "ascii", "fullword", "private"},
+		}[kind]
+		ok := false
+		for _, a := range allowed {
+			ok = ok || a == tok.text
+		}
+		if !ok {
+			return nil, p.errorf(tok.line, "modifier %s is not supported for %s", tok.text, id.text)
+		}
+		modifiers[tok.text] = true
+	}
+	s.fullword = modifiers["fullword"]
+	s.private = modifiers["private"]
+
+	switch kind {
+	case '"':
+		if !modifiers["wide"] || modifiers["ascii"] {
+			s.seqs = append(s.seqs, yaraTextTokens(text, false, modifiers["nocase"]))
+		}
+		if modifiers["wide"] {
+			s.seqs = append(s.seqs, yaraTextTokens(text, true, modifiers["nocase"]))
+		}
+	case '/':
+		flags := "(?"
+		if strings.ContainsRune(reFlags, 'i') || modifiers["nocase"] {
+			flags += "i"
+		}
+		if strings.ContainsRune(reFlags, 's') {
+			flags += "s"
+		}
+		if flags == "(?" {
+			flags = ""
+		} else {
+			flags += ")"
+		}
+		re, err := regexp.Compile(flags + reSrc)
+		if err != nil {
+			return nil, p.errorf(id.line, "invalid regular expression %s: %v", id.text, err)
+		}
+		s.re = re
+	}
+	return s, nil
+}
+
+func yaraTextTokens(text string, wide, nocase bool) []yaraToken {
+	var seq []yaraToken
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		isLetter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		seq = append(seq, yaraToken{value: lowerByte(c), mask: 0xff, nocase: nocase && isLetter})
+		if !nocase || !isLetter {
+			seq[len(seq)-1].value = c
+		}
+		if wide {
+			seq = append(seq, yaraToken{value: 0, mask: 0xff})
+		}
+	}
+	return seq
+}
+
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// Conditions
+
+// yaraExpr is a node of a condition.  Booleans are 1 or 0.
+type yaraExpr interface {
+	eval(s *yaraScan) int64
+}
+
+func (p *yaraParser) parseOr() (yaraExpr, error) {
+	return p.parseBinary("or", p.parseAnd)
+}
+
+func (p *yaraParser) parseAnd() (yaraExpr, error) {
+	return p.parseBinary("and", p.parseNot)
+}
+
+func (p *yaraParser) parseBinary(op string, operand func() (yaraExpr, error)) (yaraExpr, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !tok.is(op) {
+			return left, nil
+		}
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &yaraBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *yaraParser) parseNot() (yaraExpr, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.is("not") {
+		p.next()
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &yaraNot{e}, nil
+	}
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if tok, err = p.peek(); err != nil {
+		return nil, err
+	}
+	switch tok.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if tok.kind != yaraPunct {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &yaraBinary{op: tok.text, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *yaraParser) parsePrimary() (yaraExpr, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok.kind {
+	case yaraNumber:
+		if next, err := p.peek(); err == nil && next.is("of") {
+			return p.parseOf(yaraConst(tok.num))
+		}
+		return yaraConst(tok.num), nil
+	case yaraStringID:
+		s, err := p.lookupString(tok)
+		if err != nil {
+			return nil, err
+		}
+		ref := &yaraStringRef{str: s}
+		next, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case next.is("at"):
+			p.next()
+			if ref.at, err = p.parsePrimary(); err != nil {
+				return nil, err
+			}
+		case next.is("in"):
+			p.next()
+			if _, err := p.expect("("); err != nil {
+				return nil, err
+			}
+			if ref.lo, err = p.parsePrimary(); err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(".."); err != nil {
+				return nil, err
+			}
+			if ref.hi, err = p.parsePrimary(); err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		return ref, nil
+	case yaraCountID:
+		s, err := p.lookupString(tok)
+		if err != nil {
+			return nil, err
+		}
+		return &yaraCount{s}, nil
+	case yaraOffsetID, yaraLengthID:
+		s, err := p.lookupString(tok)
+		if err != nil {
+			return nil, err
+		}
+		m := &yaraMatchAttr{str: s, index: yaraConst(1), length: tok.kind == yaraLengthID}
+		if next, err := p.peek(); err == nil && next.is("[") {
+			p.next()
+			if m.index, err = p.parseOr(); err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case yaraIdent:
+		switch tok.text {
+		case "true":
+			return yaraConst(1), nil
+		case "false":
+			return yaraConst(0), nil
+		case "filesize":
+			return yaraFilesize{}, nil
+		case "any", "all", "none":
+			return p.parseOf(yaraQuantifier(tok.text))
+		case "for", "them", "entrypoint", "of", "at", "in":
+			return nil, p.errorf(tok.line, "%s is not supported here", tok.text)
+		}
+		for _, r := range p.rs.rules {
+			if r.name == tok.text {
+				return &yaraRuleRef{r}, nil
+			}
+		}
+		return nil, p.errorf(tok.line, "undefined identifier %s", tok.text)
+	}
+	if tok.is("(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	if tok.is("-") {
+		n, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if n.kind != yaraNumber {
+			return nil, p.errorf(n.line, "expected a number, got %s", n)
+		}
+		return yaraConst(-n.num), nil
+	}
+	return nil, p.errorf(tok.line, "unexpected %s in condition", tok)
+}
+
+// parseOf parses "of them" or "of ($a, $b*)" after a quantifier.
+func (p *yaraParser) parseOf(quantifier yaraExpr) (yaraExpr, error) {
+	if _, err := p.expect("of"); err != nil {
+		return nil, err
+	}
+	of := &yaraOf{quantifier: quantifier}
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.is("them") {
+		of.strs = p.rule.strings
+	} else if tok.is("(") {
+		for {
+			id, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if id.kind != yaraStringID {
+				return nil, p.errorf(id.line, "expected a string, got %s", id)
+			}
+			found := false
+			for _, s := range p.rule.strings {
+				prefix := strings.TrimSuffix(id.text, "*")
+				if s.id == id.text || (prefix != id.text && strings.HasPrefix(s.id, prefix)) {
+					of.strs = append(of.strs, s)
+					found = true
+				}
+			}
+			if !found {
+				return nil, p.errorf(id.line, "undefined string %s", id.text)
+			}
+			sep, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if sep.is(")") {
+				break
+			}
+			if !sep.is(",") {
+				return nil, p.errorf(sep.line, "expected , or ), got %s", sep)
+			}
+		}
+	} else {
+		return nil, p.errorf(tok.line, "expected them or a list of strings, got %s", tok)
+	}
+	if len(of.strs) == 0 {
+		return nil, p.errorf(tok.line, "rule %s has no strings", p.rule.name)
+	}
+	return of, nil
+}
+
+func (p *yaraParser) lookupString(tok yaraTok) (*yaraString, error) {
+	for _, s := range p.rule.strings {
+		if s.id == tok.text && s.id != "$" {
+			return s, nil
+		}
+	}
+	return nil, p.errorf(tok.line, "undefined string %s", tok.text)
+}
+
+// Scanning
+
+// yaraScan evaluates the rules against one value, finding the matches of
+// each string when first needed.
+type yaraScan struct {
+	data      []byte
+	matches   map[*yaraString][]yaraMatch
+	results   map[*yaraRule]bool
+	truncated map[*yaraString]bool
+}
+
+// yaraRuleMatch is a rule that matched, and its strings that were found.
+type yaraRuleMatch struct {
+	rule    *yaraRule
+	strings []string
+}
+
+// scan returns the public rules matching the data.
+func (rs *yaraRuleSet) scan(data []byte) []yaraRuleMatch {
+	matched, _ := rs.scanReport(data)
+	return matched
+}
+
+// scanReport returns the public rules matching the data, and the strings,
+// as rule:$id, whose search stopped at the limits on matches or work, so
+// that later matches of them may have been missed.
+func (rs *yaraRuleSet) scanReport(data []byte) ([]yaraRuleMatch, []string) {
+	s := &yaraScan{
+		data:      data,
+		matches:   make(map[*yaraString][]yaraMatch),
+		results:   make(map[*yaraRule]bool),
+		truncated: make(map[*yaraString]bool),
+	}
+	var matched []yaraRuleMatch
+	for _, r := range rs.rules {
+		if !s.ruleMatches(r) || r.private {
+			continue
+		}
+		m := yaraRuleMatch{rule: r}
+		for _, str := range r.strings {
+			if !str.private && len(s.find(str)) > 0 {
+				m.strings = append(m.strings, str.id)
+			}
+		}
+		matched = append(matched, m)
+	}
+	var truncated []string
+	for _, r := range rs.rules {
+		for _, str := range r.strings {
+			if s.truncated[str] {
+				truncated = append(truncated, r.name+":"+str.id)
+			}
+		}
+	}
+	return matched, truncated
+}
+
+func (s *yaraScan) ruleMatches(r *yaraRule) bool {
+	res, ok := s.results[r]
+	if !ok {
+		res = r.condition.eval(s) != 0
+		s.results[r] = res
+	}
+	return res
+}
+
+func (s *yaraScan) find(str *yaraString) []yaraMatch {
+	if m, ok := s.matches[str]; ok {
+		return m
+	}
+	var matches []yaraMatch
+	if str.re != nil {
+		for _, loc := range str.re.FindAllIndex(s.data, maxYaraStringMatches+1) {
+			matches = append(matches, yaraMatch{loc[0], loc[1] - loc[0]})
+		}
+	} else {
+		m := &yaraSeqMatcher{data: s.data}
+		first, skip := str.firstByte()
+		for pos := 0; pos < len(s.data) && len(matches) <= maxYaraStringMatches && !m.exhausted(); pos++ {
+			// Skip ahead when every variant starts with the same exact byte
+			if skip {
+				next := bytes.IndexByte(s.data[pos:], first)
+				if next == -1 {
+					break
+				}
+				pos += next
+			}
+			for _, seq := range str.seqs {
+				if end, ok := m.match(pos, seq, nil); ok {
+					matches = append(matches, yaraMatch{pos, end - pos})
+					break
+				}
+			}
+		}
+		if m.exhausted() {
+			s.truncated[str] = true
+		}
+	}
+	if len(matches) > maxYaraStringMatches {
+		matches = matches[:maxYaraStringMatches]
+		s.truncated[str] = true
+	}
+	if str.fullword {
+		words := matches[:0]
+		for _, m := range matches {
+			if isFullword(s.data, m) {
+				words = append(words, m)
+			}
+		}
+		matches = words
+	}
+	s.matches[str] = matches
+	return matches
+}
+
+// firstByte returns the byte every match must start with, if there is one.
+func (str *yaraString) firstByte() (byte, bool) {
+	var first byte
+	for i, seq := range str.seqs {
+		tok := seq[0]
+		if tok.mask != 0xff || tok.nocase || tok.jump || tok.alts != nil || (i > 0 && tok.value != first) {
+			return 0, false
+		}
+		first = tok.value
+	}
+	return first, len(str.seqs) > 0
+}
+
+func isFullword(data []byte, m yaraMatch) bool {
+	if m.offset > 0 && isYaraIdentChar(data[m.offset-1]) {
+		return false
+	}
+	end := m.offset + m.length
+	return end >= len(data) || !isYaraIdentChar(data[end])
+}
+
+// Like YARA, the work done for each string in a scan is bounded: jumps are
+// limited in length when rules are compiled, and matching stops after a
+// number of matches or of attempts made at jumps, where hex strings
+// backtrack.  Scans stopped early are reported.
+const (
+	maxYaraJump          = 1024
+	maxYaraStringMatches = 10000
+	maxYaraJumpSteps     = 1 << 20
+)
+
+// yaraSeqMatcher matches token sequences in data, counting the attempts made
+// at jumps.
+type yaraSeqMatcher struct {
+	data  []byte
+	steps int
+}
+
+// yaraCont is the rest of the sequence to match after an alternative.
+type yaraCont struct {
+	seq  []yaraToken
+	next *yaraCont
+}
+
+func (m *yaraSeqMatcher) exhausted() bool {
+	return m.steps >= maxYaraJumpSteps
+}
+
+// match returns the end of the match of seq, then cont, at pos, if any.
+func (m *yaraSeqMatcher) match(pos int, seq []yaraToken, cont *yaraCont) (int, bool) {
+	data := m.data
+	for i, tok := range seq {
+		switch {
+		case tok.jump:
+			max := tok.max
+			if max > len(data)-pos {
+				max = len(data) - pos
+			}
+			for n := tok.min; n <= max && !m.exhausted(); n++ {
+				m.steps++
+				if end, ok := m.match(pos+n, seq[i+1:], cont); ok {
+					return end, true
+				}
+			}
+			return 0, false
+		case tok.alts != nil:
+			for _, alt := range tok.alts {
+				if !yaraSimpleSeq(alt) {
+					if end, ok := m.match(pos, alt, &yaraCont{seq[i+1:], cont}); ok {
+						return end, true
+					}
+					continue
+				}
+				if end, ok := m.match(pos, alt, nil); ok {
+					if end, ok := m.match(end, seq[i+1:], cont); ok {
+						return end, true
+					}
+				}
+			}
+			return 0, false
+		}
+		if pos >= len(data) {
+			return 0, false
+		}
+		c := data[pos]
+		if tok.nocase {
+			c = lowerByte(c)
+		}
+		if c&tok.mask != tok.value {
+			return 0, false
+		}
+		pos++
+	}
+	if cont != nil {
+		return m.match(pos, cont.seq, cont.next)
+	}
+	return pos, true
+}
+
+// yaraSimpleSeq returns true if seq has no jumps or alternatives, so it has at
+// most one match at a position.
+func yaraSimpleSeq(seq []yaraToken) bool {
+	for _, tok := range seq {
+		if tok.jump || tok.alts != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Condition nodes
+
+type yaraConst int64
+
+func (c yaraConst) eval(_ *yaraScan) int64 { return int64(c) }
+
+type yaraFilesize struct{}
+
+func (yaraFilesize) eval(s *yaraScan) int64 { return int64(len(s.data)) }
+
+// yaraQuantifier is any, all or none before "of".
+type yaraQuantifier string
+
+func (yaraQuantifier) eval(_ *yaraScan) int64 { return 0 }
+
+func yaraBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type yaraBinary struct {
+	op          string
+	left, right yaraExpr
+}
+
+func (b *yaraBinary) eval(s *yaraScan) int64 {
+	l := b.left.eval(s)
+	switch b.op {
+	case "and":
+		return yaraBool(l != 0 && b.right.eval(s) != 0)
+	case "or":
+		return yaraBool(l != 0 || b.right.eval(s) != 0)
+	}
+	r := b.right.eval(s)
+	switch b.op {
+	case "==":
+		return yaraBool(l == r)
+	case "!=":
+		return yaraBool(l != r)
+	case "<":
+		return yaraBool(l < r)
+	case "<=":
+		return yaraBool(l <= r)
+	case ">":
+		return yaraBool(l > r)
+	}
+	return yaraBool(l >= r)
+}
+
+type yaraNot struct {
+	e yaraExpr
+}
+
+func (n *yaraNot) eval(s *yaraScan) int64 { return yaraBool(n.e.eval(s) == 0) }
+
+type yaraStringRef struct {
+	str        *yaraString
+	at, lo, hi yaraExpr
+}
+
+func (r *yaraStringRef) eval(s *yaraScan) int64 {
+	for _, m := range s.find(r.str) {
+		switch {
+		case r.at != nil:
+			if int64(m.offset) == r.at.eval(s) {
+				return 1
+			}
+		case r.lo != nil:
+			if off := int64(m.offset); off >= r.lo.eval(s) && off <= r.hi.eval(s) {
+				return 1
+			}
+		default:
+			return 1
+		}
+	}
+	return 0
+}
+
+type yaraCount struct {
+	str *yaraString
+}
+
+func (c *yaraCount) eval(s *yaraScan) int64 { return int64(len(s.find(c.str))) }
+
+// yaraMatchAttr is the offset (@a[i]) or length (!a[i]) of the i'th match,
+// counting from 1, or -1 if there is no such match.
+type yaraMatchAttr struct {
+	str    *yaraString
+	index  yaraExpr
+	length bool
+}
+
+func (a *yaraMatchAttr) eval(s *yaraScan) int64 {
+	matches := s.find(a.str)
+	i := a.index.eval(s)
+	if i < 1 || i > int64(len(matches)) {
+		return -1
+	}
+	if a.length {
+		return int64(matches[i-1].length)
+	}
+	return int64(matches[i-1].offset)
+}
+
+type yaraOf struct {
+	quantifier yaraExpr
+	strs       []*yaraString
+}
+
+func (o *yaraOf) eval(s *yaraScan) int64 {
+	found := 0
+	for _, str := range o.strs {
+		if len(s.find(str)) > 0 {
+			found++
+		}
+	}
+	switch q := o.quantifier.(type) {
+	case yaraQuantifier:
+		switch q {
+		case "any":
+			return yaraBool(found > 0)
+		case "all":
+			return yaraBool(found == len(o.strs))
+		}
+		return yaraBool(found == 0)
+	}
+	return yaraBool(int64(found) >= o.quantifier.eval(s))
+}
+
+type yaraRuleRef struct {
+	rule *yaraRule
+}
+
+func (r *yaraRuleRef) eval(s *yaraScan) int64 { return yaraBool(s.ruleMatches(r.rule)) }
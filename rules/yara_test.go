@@ -0,0 +1,246 @@
+package rules
+
+import (
+	"github.com/Matir/httpwatch/httpsource"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testYaraRules = `
+/* Test rules */
+private rule php_tag {
+  strings:
+    $php = "<?php" nocase
+  condition:
+    $php at 0 or $php in (0..16)
+}
+
+rule webshell : php shell {
+  meta:
+    author = "test"
+    score = 80
+  strings:
+    $eval = /eval\s*\(\s*\$_(GET|POST|REQUEST)/ nocase
+    $sys = "system" fullword
+    $b64 = "base64_decode"
+  condition:
+    php_tag and ($eval or 2 of ($sys, $b64))
+}
+
+rule mz_header {
+  strings:
+    $mz = { 4D 5A ?? 00 [0-4] 50 (45 | 46) }
+    $wide = "cmd" wide
+  condition:
+    $mz at 0 or #wide >= 2
+}
+
+rule small_all {
+  strings:
+    $a1 = "alpha"
+    $a2 = "beta"
+    $x = "gamma" private
+  condition:
+    all of ($a*) and filesize < 1KB and @a2[1] > @a1 and !a1 == 5
+}
+`
+
+func TestYaraScan(t *testing.T) {
+	rs, err := compileYara("test.yar", testYaraRules)
+	if err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+	tests := []struct {
+		data     string
+		expected []string
+	}{
+		{"<?PHP eval($_POST['x']);", []string{"webshell"}},
+		{"<?php system(base64_decode($x));", []string{"webshell"}},
+		{"<?php systems(base64_decode($x));", []string{}},
+		{"eval($_GET[1])", []string{}},
+		{"MZ\x90\x00\x01\x02PE\x00", []string{"mz_header"}},
+		{"MZ\x90\x00PF", []string{"mz_header"}},
+		{"xMZ\x90\x00PE", []string{}},
+		{"c\x00m\x00d\x00 c\x00m\x00d\x00", []string{"mz_header"}},
+		{"alpha beta gamma", []string{"small_all"}},
+		{"beta alpha", []string{}},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, m := range rs.scan([]byte(test.data)) {
+			names = append(names, m.rule.name)
+		}
+		if !equalValues(names, test.expected) {
+			t.Errorf("%q: expected %v, got %v\n", test.data, test.expected, names)
+		}
+	}
+
+	found := rs.scan([]byte("alpha beta gamma"))
+	if len(found) != 1 || !equalValues(found[0].strings, []string{"$a1", "$a2"}) {
+		t.Errorf("Expected the public strings of small_all, got %v\n", found)
+	}
+}
+
+func TestYaraHexString(t *testing.T) {
+	rs, err := compileYara("hex.yar", `rule h { strings: $h = { 4? ?1 [2] ( 01 02 | 03 ) [1-4] FF } condition: #h == 1 }`)
+	if err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+	tests := map[string]bool{
+		"\x41\x31ab\x01\x02c\xff": true,
+		"\x4f\x01ab\x03cc\xff":    true,
+		"\x41\x31ab\x03\xff":      false,
+		"\x51\x31ab\x03c\xff":     false,
+		"\x41\x32ab\x03c\xff":     false,
+	}
+	for data, expected := range tests {
+		if res := len(rs.scan([]byte(data))) > 0; res != expected {
+			t.Errorf("%q: expected %v, got %v\n", data, expected, res)
+		}
+	}
+}
+
+func TestYaraAlternatives(t *testing.T) {
+	rs, err := compileYara("alt.yar", `rule a { strings: $a = { 41 ( 42 [1-2] 43 | 44 ) 45 } condition: $a }`)
+	if err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+	tests := map[string]bool{
+		"xAB.CE":  true,
+		"xAB..CE": true,
+		"xADE":    true,
+		"xABCE":   false,
+		"xAB.CD":  false,
+	}
+	for data, expected := range tests {
+		if res := len(rs.scan([]byte(data))) > 0; res != expected {
+			t.Errorf("%q: expected %v, got %v\n", data, expected, res)
+		}
+	}
+}
+
+func TestYaraBacktrackingBound(t *testing.T) {
+	rs, err := compileYara("jumps.yar", `
+rule never { strings: $a = { 61 [0-1024] 62 [0-1024] 63 } condition: $a }
+rule alts { strings: $a = { 61 [0-1000] ( 62 | 61 [0-1024] 78 ) [0-1024] 64 } condition: $a }
+rule far { strings: $a = { 78 [0-1024] 79 } condition: $a }
+rule many { strings: $a = "b" condition: $a }
+`)
+	if err != nil {
+		t.Fatalf("Unable to compile: %v\n", err)
+	}
+	data := []byte(strings.Repeat("ab", 128*1024))
+	start := time.Now()
+	m, truncated := rs.scanReport(data)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Scan of %d bytes took %v\n", len(data), elapsed)
+	}
+	if len(m) != 1 || m[0].rule.name != "many" {
+		t.Errorf("Expected only many to match, got %v\n", m)
+	}
+	// The work for each string and the matches of many are limited
+	if !equalValues(truncated, []string{"never:$a", "alts:$a", "many:$a"}) {
+		t.Errorf("Expected the scans to be reported as truncated, got %v\n", truncated)
+	}
+	if m, truncated := rs.scanReport([]byte("x" + strings.Repeat(".", maxYaraJump) + "y")); len(m) != 1 || len(truncated) != 0 {
+		t.Errorf("Expected a match within the longest jump, got %v %v\n", m, truncated)
+	}
+	if m := rs.scan([]byte("x" + strings.Repeat(".", maxYaraJump+1) + "y")); len(m) != 0 {
+		t.Errorf("Expected no match beyond the longest jump, got %v\n", m)
+	}
+}
+
+func TestYaraErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{`import "pe"`, "t.yar:1: import is not supported"},
+		{"rule a {\n condition:\n $a }", "t.yar:3: undefined string $a"},
+		{`rule a { strings: $a = "x" xor condition: $a }`, "modifier xor is not supported"},
+		{`rule a { strings: $a = { 4D [2] } condition: $a }`, "must start and end with a byte"},
+		{`rule a { strings: $a = { 4D [-] 5A } condition: $a }`, "hex string $a: unbounded jump [0-]"},
+		{`rule a { strings: $a = { 4D [0-4000] 5A } condition: $a }`, "hex string $a: jump [0-4000] is longer than 1024 bytes"},
+		{`rule a { strings: $b = { 4D ( 01 [2-] 02 | 03 ) 5A } condition: $b }`, "hex string $b: unbounded jump [2-]"},
+		{`rule a { strings: $a = /(/ condition: $a }`, "invalid regular expression"},
+		{`rule a { condition: b }`, "undefined identifier b"},
+		{`rule a { condition: true } rule a { condition: false }`, "duplicate rule a"},
+		{`rule a { strings: $a = "x" condition: for any of them : ($) }`, "for is not supported"},
+		{`global rule a { condition: true }`, "global rules are not supported"},
+		{`rule a { strings: $a = "x" condition: $a`, "end of file"},
+		{`rule a { strings: $a = "x /* */ condition: $a }`, "unterminated string"},
+	}
+	for _, test := range tests {
+		_, err := compileYara("t.yar", test.src)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v\n", test.src, test.err, err)
+		}
+	}
+}
+
+func TestYaraEvaluator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yara")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "rules.yar")
+	if err := ioutil.WriteFile(filename, []byte(testYaraRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "http://example.com/upload.php", nil)
+	pair := &httpsource.RequestResponsePair{Request: req, RequestBody: []byte("<?php eval($_REQUEST['c']); system('id');")}
+	a := Rule{Name: "a", Operator: "yara", Field: "request.body", Value: filename}
+	b := Rule{Name: "b", Expr: "request.body yara '" + filename + "'"}
+	for _, r := range []*Rule{&a, &b} {
+		if err := r.Compile(); err != nil {
+			t.Fatalf("Unable to compile: %v\n", err)
+		}
+		if !r.Eval(pair) {
+			t.Errorf("Expected %s to match.\n", r.Name)
+		}
+	}
+	if a.evaluator.(*YaraEvaluator).rs != b.evaluator.(*YaraEvaluator).rs {
+		t.Errorf("Expected rules with the same file to share the compiled rules.\n")
+	}
+
+	m := NewMatch(&a, pair)
+	if !equalValues(m.Metadata["yara.rules"], []string{"webshell"}) {
+		t.Errorf("Unexpected rules %v\n", m.Metadata["yara.rules"])
+	}
+	if !equalValues(m.Metadata["yara.strings"], []string{"webshell:$eval", "webshell:$sys"}) {
+		t.Errorf("Unexpected strings %v\n", m.Metadata["yara.strings"])
+	}
+	if !equalValues(m.Metadata["yara.tags"], []string{"php", "shell"}) {
+		t.Errorf("Unexpected tags %v\n", m.Metadata["yara.tags"])
+	}
+
+	// Matches beyond the limit are reported as missed
+	big := &httpsource.RequestResponsePair{Request: req, RequestBody: []byte("<?php eval($_GET[1]); " + strings.Repeat("system ", maxYaraStringMatches+1))}
+	if !a.Eval(big) {
+		t.Errorf("Expected a match.\n")
+	}
+	if m := NewMatch(&a, big); !equalValues(m.Metadata["yara.truncated"], []string{"webshell:$sys"}) {
+		t.Errorf("Expected the truncated string, got %v\n", m.Metadata["yara.truncated"])
+	}
+	if _, ok := NewMatch(&a, pair).Metadata["yara.truncated"]; ok {
+		t.Errorf("Expected no truncated strings.\n")
+	}
+
+	clean := &httpsource.RequestResponsePair{Request: req, RequestBody: []byte("hello")}
+	if a.Eval(clean) {
+		t.Errorf("Expected no match.\n")
+	}
+
+	if _, err := BuildEvaluator(&Rule{Operator: "yara", Field: "request.body"}); err == nil {
+		t.Errorf("Expected an error without a rule file.\n")
+	}
+	if _, err := BuildEvaluator(&Rule{Operator: "yara", Field: "request.body", Value: filepath.Join(dir, "missing.yar")}); err == nil {
+		t.Errorf("Expected an error for a missing file.\n")
+	}
+}